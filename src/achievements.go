@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Achievements are worked out from the whole of a user's history after
+// anything that could earn one is recorded. Each is stored once, with the
+// date it was first earned, apart from the lowest trend weight which is a
+// record that gets updated whenever it's beaten.
+
+var weighInStreaks = []int{7, 30, 100, 365}
+var underBudgetDays = []int{1, 10, 50, 100, 365}
+
+const lowestTrendCode = "lowest_trend"
+
+type achievement struct {
+	Code  string
+	Title string
+	Date  string
+	Value float64
+}
+
+func getAchievements(username string) ([]achievement, error) {
+	rows, err := database.Query("SELECT code, title, date, value FROM achievement WHERE username = ? ORDER BY date, id", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]achievement, 0)
+	for rows.Next() {
+		var a achievement
+		err = rows.Scan(&a.Code, &a.Title, &a.Date, &a.Value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+// saveAchievements keeps the first date each achievement was earned, since
+// achievements are recalculated from scratch every time.
+func saveAchievements(achievements []achievement, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, a := range achievements {
+		if a.Code == lowestTrendCode {
+			_, err = tx.Exec(`
+				INSERT INTO achievement (code, title, date, value, username) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (username, code) DO UPDATE SET title = excluded.title, date = excluded.date, value = excluded.value
+				WHERE excluded.value < achievement.value`,
+				a.Code, a.Title, a.Date, a.Value, username)
+		} else {
+			_, err = tx.Exec("INSERT OR IGNORE INTO achievement (code, title, date, value, username) VALUES (?, ?, ?, ?, ?)",
+				a.Code, a.Title, a.Date, a.Value, username)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// calcAchievements works through the days in order. Today isn't over yet, so
+// it can't count as a day under budget until tomorrow.
+func calcAchievements(days []recordedDay, timeline goalTimeline, now time.Time) []achievement {
+	result := make([]achievement, 0)
+	if len(days) == 0 {
+		return result
+	}
+
+	streak, underBudget := 0, 0
+	var previous time.Time
+	for _, day := range days {
+		date, err := time.Parse(time.RFC3339, day.Date)
+		if err != nil {
+			continue
+		}
+
+		if streak > 0 && date.AddDate(0, 0, -1).Format("2006-01-02") == previous.Format("2006-01-02") {
+			streak++
+		} else {
+			streak = 1
+		}
+		previous = date
+		for _, target := range weighInStreaks {
+			if streak == target {
+				result = append(result, achievement{fmt.Sprintf("weigh_in_streak_%d", target), fmt.Sprintf("Weighed in %d days in a row", target), day.Date[:10], float64(target)})
+			}
+		}
+
+		if day.Date[:10] >= now.Format("2006-01-02") {
+			continue
+		}
+		dayMax := calcDayMax(timeline.on(date), day.Weight, date)
+		if dayMax == nil || len(day.Entries) == 0 {
+			continue
+		}
+		total := 0
+		for _, entry := range day.Entries {
+			total += entry.Amount
+		}
+		if total <= *dayMax {
+			underBudget++
+			for _, target := range underBudgetDays {
+				if underBudget != target {
+					continue
+				}
+				title := fmt.Sprintf("Stayed under budget on %d days", target)
+				if target == 1 {
+					title = "Stayed under budget for the first time"
+				}
+				result = append(result, achievement{fmt.Sprintf("under_budget_%d", target), title, day.Date[:10], float64(target)})
+			}
+		}
+	}
+
+	trend := calcWeightTrend(days)
+	start, lowest := trend[0].Weighted, trend[0]
+	lost := 0
+	for _, entry := range trend {
+		for float64(lost+1) <= start-entry.Weighted {
+			lost++
+			result = append(result, achievement{fmt.Sprintf("trend_lost_%d", lost), fmt.Sprintf("Lost %d kg on the trend", lost), entry.Date, float64(lost)})
+		}
+		if entry.Weighted < lowest.Weighted {
+			lowest = entry
+		}
+	}
+	if lowest.Weighted < start {
+		result = append(result, achievement{lowestTrendCode, fmt.Sprintf("Lowest trend weight of %g kg", lowest.Weighted), lowest.Date, lowest.Weighted})
+	}
+
+	for _, g := range timeline.phases {
+		if g.Status == goalAchieved && g.Kind != "maintain" {
+			result = append(result, achievement{fmt.Sprintf("goal_reached_%d", g.ID), fmt.Sprintf("Reached a %s goal of %g kg", g.Kind, g.TargetWeight), g.EndDate, g.TargetWeight})
+		}
+	}
+
+	return result
+}
+
+func evaluateAchievements(username string) error {
+	days, err := allDaysForUser(username)
+	if err != nil {
+		return err
+	}
+
+	timeline, err := getGoalTimeline(username)
+	if err != nil {
+		return err
+	}
+
+	return saveAchievements(calcAchievements(days, *timeline, time.Now()), username)
+}
+
+// statusRecorder remembers the status a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// withAchievements wraps a handler that records something achievements are
+// based on, re-evaluating them after each successful write. The write has
+// already happened by then, so a failure here is only logged.
+func withAchievements(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{w, http.StatusOK}
+		h(recorder, r)
+		if r.Method != "POST" || recorder.status != http.StatusAccepted {
+			return
+		}
+
+		err := evaluateAchievements(currentUser(r))
+		if err != nil {
+			logError(r, err)
+		}
+	}
+}
+
+func achievementsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	result, err := getAchievements(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(result)
+	case mimeText:
+		for _, a := range result {
+			fmt.Fprintf(w, "%s\t%s\n", a.Date, a.Title)
+		}
+	}
+}
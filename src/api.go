@@ -0,0 +1,552 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The versioned API sits alongside the routes used by the app itself. It
+// takes and returns JSON, created resources are returned in the response,
+// and errors are reported as they are everywhere else. The routes are
+// described in a table, from which both the request routing and the OpenAPI
+// document are generated, so the two can't drift apart.
+
+const apiPrefix = "/api/v1"
+const maxAPIBodyBytes = 1 << 20
+
+type apiRoute struct {
+	Method   string
+	Path     string
+	Summary  string
+	Query    []string
+	Request  interface{}
+	Response interface{}
+	Status   int
+	handle   func(w http.ResponseWriter, r *http.Request, id int)
+}
+
+type weightRequest struct {
+	Weight float64
+	Date   string `json:",omitempty"`
+}
+
+type calorieRequest struct {
+	Amount   int
+	Category string
+	Date     string `json:",omitempty"`
+}
+
+type categoryRequest struct {
+	DisplayOrder  *int
+	Colour        *string
+	Archived      *bool
+	BudgetPercent *float64
+}
+
+type goalRequest struct {
+	Kind            string
+	TargetWeight    float64
+	TargetDate      string `json:",omitempty"`
+	BurnRate        int    `json:",omitempty"`
+	Band            float64
+	IncludeExercise *bool `json:",omitempty"`
+}
+
+var apiRoutes []apiRoute
+
+// goalRequestFields maps the form field names used when validating goals to
+// the fields of a goalRequest.
+var goalRequestFields = map[string]string{
+	"kind":            "Kind",
+	"target_weight":   "TargetWeight",
+	"target_date":     "TargetDate",
+	"daily_burn_rate": "BurnRate",
+	"band":            "Band",
+}
+
+func setupAPIRoutes() {
+	apiRoutes = []apiRoute{
+		{"GET", "/weights", "List recorded weights", nil, nil, []weightEntry{}, 200, apiListWeights},
+		{"POST", "/weights", "Record a weight", nil, weightRequest{}, weightEntry{}, 201, apiAddWeight},
+		{"GET", "/weights/{id}", "Get a recorded weight", nil, nil, weightEntry{}, 200, apiGetWeight},
+		{"DELETE", "/weights/{id}", "Delete a recorded weight", nil, nil, nil, 204, apiDeleteWeight},
+		{"GET", "/calories", "List calorie entries for a day, today by default", []string{"date"}, nil, []datedCalorieEntry{}, 200, apiListCalories},
+		{"POST", "/calories", "Record a calorie entry", nil, calorieRequest{}, datedCalorieEntry{}, 201, apiAddCalories},
+		{"GET", "/calories/{id}", "Get a calorie entry", nil, nil, datedCalorieEntry{}, 200, apiGetCalories},
+		{"DELETE", "/calories/{id}", "Delete a calorie entry", nil, nil, nil, 204, apiDeleteCalories},
+		{"GET", "/categories", "List categories", nil, nil, []category{}, 200, apiListCategories},
+		{"PATCH", "/categories/{id}", "Update a category", nil, categoryRequest{}, category{}, 200, apiUpdateCategory},
+		{"GET", "/goals", "Get the current goal", nil, nil, goalsSummary{}, 200, apiGetGoals},
+		{"PUT", "/goals", "Replace the current goal", nil, goalRequest{}, goalsSummary{}, 200, apiSetGoals},
+		{"GET", "/goals/phases", "List past, current and planned goals", nil, nil, []goalPhase{}, 200, apiListGoalPhases},
+		{"POST", "/goals/phases", "Plan a goal to follow the current one", nil, goalRequest{}, goalPhase{}, 201, apiAddGoalPhase},
+		{"DELETE", "/goals/phases/{id}", "Delete a planned goal", nil, nil, nil, 204, apiDeleteGoalPhase},
+		{"GET", "/history", "List every recorded day", nil, nil, []recordedDay{}, 200, apiHistory},
+		{"GET", "/trend", "List the weight trend", nil, nil, []trendEntry{}, 200, apiTrend},
+		{"GET", "/openapi.json", "Get this API's OpenAPI document", nil, nil, nil, 200, apiOpenAPI},
+	}
+}
+
+// match checks a request path against the route's, where {id} stands for a
+// whole number.
+func (route apiRoute) match(path string) (int, bool) {
+	want := strings.Split(route.Path, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return 0, false
+	}
+
+	id := 0
+	for i := range want {
+		if want[i] == "{id}" {
+			var err error
+			if id, err = strconv.Atoi(got[i]); err != nil {
+				return 0, false
+			}
+		} else if want[i] != got[i] {
+			return 0, false
+		}
+	}
+	return id, true
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+
+	allowed := []string{}
+	for _, route := range apiRoutes {
+		id, ok := route.match(path)
+		if !ok {
+			continue
+		}
+		if route.Method == r.Method {
+			route.handle(w, r, id)
+			return
+		}
+		allowed = append(allowed, route.Method)
+	}
+
+	if len(allowed) == 0 {
+		writeError(w, r, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "no such resource"})
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, r, http.StatusMethodNotAllowed, errorResponse{Code: codeMethodNotAllowed, Message: "method not allowed"})
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", mimeJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// readAPIRequest decodes a JSON body, rejecting fields that aren't part of
+// the request so that typos don't go unnoticed.
+func readAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, r, http.StatusBadRequest, errorResponse{Code: codeInvalidRequest, Message: "invalid JSON body: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+// apiDate reads an optional date, in the form yyyy-mm-dd, defaulting to now.
+// Entries for other days are recorded at midday, safely inside the day.
+func apiDate(date string) (time.Time, bool) {
+	if date == "" {
+		return time.Now(), true
+	}
+	day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return day, false
+	}
+	return day.Add(12 * time.Hour), true
+}
+
+// evaluateAchievementsAfter is for writes that can earn achievements; the
+// write has already succeeded, so failures are only logged.
+func evaluateAchievementsAfter(r *http.Request) {
+	if err := evaluateAchievements(currentUser(r)); err != nil {
+		logError(r, err)
+	}
+}
+
+func apiListWeights(w http.ResponseWriter, r *http.Request, id int) {
+	result, err := getWeightEntries(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, result)
+}
+
+func apiAddWeight(w http.ResponseWriter, r *http.Request, id int) {
+	var req weightRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	day, ok := apiDate(req.Date)
+	if !ok {
+		validationFailed(w, r, "invalid weight", []validationError{{Field: "Date", Message: "date must be in the form yyyy-mm-dd"}})
+		return
+	}
+	if req.Weight <= 0 || req.Weight > 500 {
+		validationFailed(w, r, "invalid weight", []validationError{{Field: "Weight", Message: "weight must be between 0 and 500 kg"}})
+		return
+	}
+
+	currentUser := currentUser(r)
+	id, err := recordWeight(day, math.Round(req.Weight*100)/100, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	evaluateAchievementsAfter(r)
+
+	result, err := getWeightEntry(id, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusCreated, result)
+}
+
+func apiGetWeight(w http.ResponseWriter, r *http.Request, id int) {
+	result, err := getWeightEntry(id, currentUser(r))
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "no such weight"})
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, result)
+}
+
+func apiDeleteWeight(w http.ResponseWriter, r *http.Request, id int) {
+	currentUser := currentUser(r)
+	_, err := getWeightEntry(id, currentUser)
+	if err == nil {
+		err = deleteWeightEntry(id, currentUser)
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "no such weight"})
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiListCalories(w http.ResponseWriter, r *http.Request, id int) {
+	day, ok := apiDate(r.FormValue("date"))
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, errorResponse{Code: codeInvalidRequest, Message: "date must be in the form yyyy-mm-dd"})
+		return
+	}
+
+	result, err := getDatedCalories(day, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, result)
+}
+
+func apiAddCalories(w http.ResponseWriter, r *http.Request, id int) {
+	var req calorieRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	day, ok := apiDate(req.Date)
+	if !ok {
+		validationFailed(w, r, "invalid calorie entry", []validationError{{Field: "Date", Message: "date must be in the form yyyy-mm-dd"}})
+		return
+	}
+	if req.Amount == 0 {
+		validationFailed(w, r, "invalid calorie entry", []validationError{{Field: "Amount", Message: "amount is required"}})
+		return
+	}
+
+	currentUser := currentUser(r)
+	id, err := addCalorieEntry(day, req.Amount, req.Category, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	evaluateAchievementsAfter(r)
+
+	result, err := getCalorieEntry(id, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusCreated, result)
+}
+
+func apiGetCalories(w http.ResponseWriter, r *http.Request, id int) {
+	result, err := getCalorieEntry(id, currentUser(r))
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "no such calorie entry"})
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, result)
+}
+
+func apiDeleteCalories(w http.ResponseWriter, r *http.Request, id int) {
+	currentUser := currentUser(r)
+	_, err := getCalorieEntry(id, currentUser)
+	if err == nil {
+		err = deleteCalorieEntry(id, currentUser)
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "no such calorie entry"})
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiListCategories(w http.ResponseWriter, r *http.Request, id int) {
+	result, err := getCategories(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, result)
+}
+
+func apiUpdateCategory(w http.ResponseWriter, r *http.Request, id int) {
+	var req categoryRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+
+	currentUser := currentUser(r)
+	categories, err := getCategories(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	var existing *category
+	for i := range categories {
+		if categories[i].ID == id {
+			existing = &categories[i]
+		}
+	}
+	if existing == nil {
+		writeError(w, r, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "no such category"})
+		return
+	}
+
+	fields := []validationError{}
+	if req.DisplayOrder != nil {
+		existing.DisplayOrder = *req.DisplayOrder
+	}
+	if req.Colour != nil {
+		if *req.Colour != "" && !colourPattern.MatchString(*req.Colour) {
+			fields = append(fields, validationError{Field: "Colour", Message: "colour must be in the form #rrggbb"})
+		}
+		existing.Colour = *req.Colour
+	}
+	if req.Archived != nil {
+		existing.Archived = *req.Archived
+	}
+	if req.BudgetPercent != nil {
+		if *req.BudgetPercent < 0 {
+			fields = append(fields, validationError{Field: "BudgetPercent", Message: "budget can't be negative"})
+		}
+		existing.BudgetPercent = *req.BudgetPercent
+	}
+	if totalCategoryBudget(categories) > 100 {
+		fields = append(fields, validationError{Field: "BudgetPercent", Message: "category budgets exceed 100%"})
+	}
+	if len(fields) > 0 {
+		validationFailed(w, r, "invalid category", fields)
+		return
+	}
+
+	err = updateCategory(*existing, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, existing)
+}
+
+func apiGetGoals(w http.ResponseWriter, r *http.Request, id int) {
+	result, err := getGoalsSummary(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, result)
+}
+
+func writeGoalValidation(w http.ResponseWriter, r *http.Request, message string, fields []validationError) {
+	for i := range fields {
+		if name, exists := goalRequestFields[fields[i].Field]; exists {
+			fields[i].Field = name
+		}
+	}
+	validationFailed(w, r, message, fields)
+}
+
+func (req goalRequest) phase() goalPhase {
+	return goalPhase{Kind: req.Kind, TargetWeight: req.TargetWeight, TargetDate: req.TargetDate, BurnRate: req.BurnRate, Band: req.Band}
+}
+
+func apiSetGoals(w http.ResponseWriter, r *http.Request, id int) {
+	var req goalRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	goal := req.phase()
+	if fields := checkGoalPhase(&goal); len(fields) > 0 {
+		writeGoalValidation(w, r, "invalid goal", fields)
+		return
+	}
+
+	currentUser := currentUser(r)
+	startWeight, err := getLatestWeight(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	profile, err := getProfile(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if v := validateGoal(goal, startWeight, profile.Sex, time.Now()); v != nil {
+		message := "goal is outside safe limits"
+		if v.SuggestedDate != "" {
+			message += ", try a target date of " + v.SuggestedDate
+		}
+		writeGoalValidation(w, r, message, v.Errors)
+		return
+	}
+
+	err = setActiveGoal(goal, time.Now(), startWeight, currentUser)
+	if err == nil && req.IncludeExercise != nil {
+		err = setSetting("include_exercise", strconv.FormatBool(*req.IncludeExercise), currentUser)
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	apiGetGoals(w, r, id)
+}
+
+func apiListGoalPhases(w http.ResponseWriter, r *http.Request, id int) {
+	result, err := getGoalPhases(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, result)
+}
+
+func apiAddGoalPhase(w http.ResponseWriter, r *http.Request, id int) {
+	var req goalRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	goal := req.phase()
+	if fields := checkGoalPhase(&goal); len(fields) > 0 {
+		writeGoalValidation(w, r, "invalid goal", fields)
+		return
+	}
+
+	currentUser := currentUser(r)
+	weight, err := getLatestWeight(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	profile, err := getProfile(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if v := validateGoal(goal, weight, profile.Sex, time.Now()); v != nil {
+		message := "goal is outside safe limits"
+		if v.SuggestedDate != "" {
+			message += ", try a target date of " + v.SuggestedDate
+		}
+		writeGoalValidation(w, r, message, v.Errors)
+		return
+	}
+
+	id, err = addPlannedGoal(goal, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	phases, err := getGoalPhases(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	for _, phase := range phases {
+		if phase.ID == id {
+			writeAPIResponse(w, http.StatusCreated, phase)
+			return
+		}
+	}
+	serverError(w, r, sql.ErrNoRows)
+}
+
+func apiDeleteGoalPhase(w http.ResponseWriter, r *http.Request, id int) {
+	err := deletePlannedGoal(id, currentUser(r))
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "no such planned goal"})
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiHistory(w http.ResponseWriter, r *http.Request, id int) {
+	result, err := allDaysForUser(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, result)
+}
+
+func apiTrend(w http.ResponseWriter, r *http.Request, id int) {
+	days, err := allDaysForUser(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, calcWeightTrend(days))
+}
+
+func apiOpenAPI(w http.ResponseWriter, r *http.Request, id int) {
+	writeAPIResponse(w, http.StatusOK, buildOpenAPI(apiRoutes))
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -17,6 +18,17 @@ type argon2Config struct {
 	keyLen  uint32
 }
 
+var errMalformedHash = errors.New("malformed password hash")
+
+// hashes asking for more than these are refused, so one planted in the
+// database can't tie up the server checking it
+const (
+	maxArgonMemory  = 1024 * 1024 // KiB, so 1 GiB
+	maxArgonTime    = 16
+	maxArgonThreads = 16
+	maxArgonKeyLen  = 128
+)
+
 func generateArgonHash(c *argon2Config, password string) (string, error) {
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
@@ -33,27 +45,60 @@ func generateArgonHash(c *argon2Config, password string) (string, error) {
 	return full, nil
 }
 
-func compareWithArgonHash(password, hash string) (bool, error) {
+// parseArgonHash reads a hash in the form made by generateArgonHash. A hash
+// that isn't in that form returns errMalformedHash rather than being trusted,
+// as its parameters decide how much work is done to check a password.
+func parseArgonHash(hash string) (*argon2Config, []byte, []byte, error) {
 	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, nil, nil, errMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errMalformedHash
+	}
 
 	c := &argon2Config{}
 	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &c.memory, &c.time, &c.threads)
-	if err != nil {
-		return false, err
+	if err != nil || c.memory == 0 || c.time == 0 || c.threads == 0 {
+		return nil, nil, nil, errMalformedHash
+	}
+	if c.memory > maxArgonMemory || c.time > maxArgonTime || c.threads > maxArgonThreads {
+		return nil, nil, nil, errMalformedHash
 	}
 
 	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
-	if err != nil {
-		return false, err
+	if err != nil || len(salt) == 0 {
+		return nil, nil, nil, errMalformedHash
 	}
 
 	decodedHash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(decodedHash) == 0 || len(decodedHash) > maxArgonKeyLen {
+		return nil, nil, nil, errMalformedHash
+	}
+	c.keyLen = uint32(len(decodedHash))
+
+	return c, salt, decodedHash, nil
+}
+
+func compareWithArgonHash(password, hash string) (bool, error) {
+	c, salt, decodedHash, err := parseArgonHash(hash)
 	if err != nil {
 		return false, err
 	}
-	c.keyLen = uint32(len(decodedHash))
 
 	comparisonHash := argon2.IDKey([]byte(password), salt, c.time, c.memory, c.threads, c.keyLen)
 
 	return (subtle.ConstantTimeCompare(decodedHash, comparisonHash) == 1), nil
 }
+
+// argonHashIsWeaker reports whether a hash was made with any lower cost than
+// the given config, and so should be replaced.
+func argonHashIsWeaker(hash string, c *argon2Config) bool {
+	h, _, _, err := parseArgonHash(hash)
+	if err != nil {
+		return false
+	}
+	return h.memory < c.memory || h.time < c.time || h.threads < c.threads || h.keyLen < c.keyLen
+}
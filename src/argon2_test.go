@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// a cheap config, so the tests don't spend their time hashing
+var testPasswordConfig = &argon2Config{time: 1, memory: 1024, threads: 1, keyLen: 32}
+
+func TestParseArgonHash(t *testing.T) {
+	valid, err := generateArgonHash(testPasswordConfig, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, "$")
+	salt, key := parts[4], parts[5]
+	largest := &argon2Config{time: maxArgonTime, memory: maxArgonMemory, threads: maxArgonThreads, keyLen: maxArgonKeyLen}
+	longestKey := base64.RawStdEncoding.EncodeToString(make([]byte, maxArgonKeyLen))
+	tooLongKey := base64.RawStdEncoding.EncodeToString(make([]byte, maxArgonKeyLen+1))
+
+	tests := []struct {
+		name   string
+		hash   string
+		config *argon2Config // nil if the hash should be refused
+	}{
+		{"generated", valid, testPasswordConfig},
+		{"empty", "", nil},
+		{"truncated", valid[:len(valid)-len(key)-1], nil},
+		{"extra part", valid + "$extra", nil},
+		{"wrong algorithm", "$argon2i$v=19$m=1024,t=1,p=1$" + salt + "$" + key, nil},
+		{"bcrypt", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", nil},
+		{"wrong version", "$argon2id$v=16$m=1024,t=1,p=1$" + salt + "$" + key, nil},
+		{"bad salt base64", "$argon2id$v=19$m=1024,t=1,p=1$not*base64$" + key, nil},
+		{"bad key base64", "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$not*base64", nil},
+		{"empty salt", "$argon2id$v=19$m=1024,t=1,p=1$$" + key, nil},
+		{"empty key", "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$", nil},
+		{"missing parameters", "$argon2id$v=19$$" + salt + "$" + key, nil},
+		{"non-numeric parameters", "$argon2id$v=19$m=lots,t=1,p=1$" + salt + "$" + key, nil},
+		{"zero memory", "$argon2id$v=19$m=0,t=1,p=1$" + salt + "$" + key, nil},
+		{"zero time", "$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + key, nil},
+		{"zero threads", "$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + key, nil},
+		{"largest parameters", "$argon2id$v=19$m=1048576,t=16,p=16$" + salt + "$" + longestKey, largest},
+		{"excessive memory", "$argon2id$v=19$m=1048577,t=1,p=1$" + salt + "$" + key, nil},
+		{"excessive time", "$argon2id$v=19$m=1024,t=17,p=1$" + salt + "$" + key, nil},
+		{"excessive threads", "$argon2id$v=19$m=1024,t=1,p=17$" + salt + "$" + key, nil},
+		{"threads overflow", "$argon2id$v=19$m=1024,t=1,p=256$" + salt + "$" + key, nil},
+		{"excessive key", "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + tooLongKey, nil},
+	}
+
+	for _, test := range tests {
+		c, _, _, err := parseArgonHash(test.hash)
+		if test.config != nil && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if test.config != nil && *c != *test.config {
+			t.Errorf("%s: got config %+v, want %+v", test.name, *c, *test.config)
+		} else if test.config == nil && err != errMalformedHash {
+			t.Errorf("%s: got error %v, want %v", test.name, err, errMalformedHash)
+		}
+	}
+}
+
+func TestCompareWithArgonHash(t *testing.T) {
+	hash, err := generateArgonHash(testPasswordConfig, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		hash     string
+		match    bool
+		err      error
+	}{
+		{"right password", "password", hash, true, nil},
+		{"wrong password", "Password", hash, false, nil},
+		{"empty password", "", hash, false, nil},
+		{"truncated hash", "password", hash[:len(hash)/2], false, errMalformedHash},
+		{"wrong algorithm", "password", strings.Replace(hash, "argon2id", "argon2i", 1), false, errMalformedHash},
+		{"bad base64", "password", hash[:len(hash)-2] + "*!", false, errMalformedHash},
+		{"excessive parameters", "password", strings.Replace(hash, "m=1024", "m=4294967295", 1), false, errMalformedHash},
+	}
+
+	for _, test := range tests {
+		match, err := compareWithArgonHash(test.password, test.hash)
+		if match != test.match || err != test.err {
+			t.Errorf("%s: got %t, %v, want %t, %v", test.name, match, err, test.match, test.err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+type categoryBudget struct {
+	Category  string
+	Budget    int
+	Consumed  int
+	Remaining int
+}
+
+type categoryBudgetHistory struct {
+	Category      string
+	BudgetPercent float64
+	DaysCounted   int
+	DaysOver      int
+	AverageOver   int
+}
+
+// calcCategoryBudgets splits a day's calorie allowance across the categories
+// that have a budget percentage, and subtracts what has been eaten in each.
+func calcCategoryBudgets(categories []category, entries []calorieEntry, dayMax int) []categoryBudget {
+	consumed := make(map[string]int)
+	for _, entry := range entries {
+		consumed[entry.Category] += entry.Amount
+	}
+
+	result := make([]categoryBudget, 0)
+	for _, c := range categories {
+		if c.Archived || c.BudgetPercent <= 0 {
+			continue
+		}
+		budget := int(math.Round(float64(dayMax) * c.BudgetPercent / 100))
+		result = append(result, categoryBudget{c.Name, budget, consumed[c.Name], budget - consumed[c.Name]})
+	}
+
+	return result
+}
+
+// calcBudgetHistory works out how often each budgeted category has gone over
+// its share, using each recorded day's weight to derive that day's allowance.
+func calcBudgetHistory(categories []category, timeline goalTimeline, days []recordedDay) []categoryBudgetHistory {
+	result := make([]categoryBudgetHistory, 0)
+	for _, c := range categories {
+		if c.Archived || c.BudgetPercent <= 0 {
+			continue
+		}
+
+		history := categoryBudgetHistory{Category: c.Name, BudgetPercent: c.BudgetPercent}
+		totalOver := 0
+		for _, day := range days {
+			date, err := time.Parse(time.RFC3339, day.Date)
+			if err != nil {
+				continue
+			}
+			dayMax := calcDayMax(timeline.on(date), day.Weight, date)
+			if dayMax == nil {
+				continue
+			}
+
+			budgets := calcCategoryBudgets([]category{c}, day.Entries, *dayMax)
+			history.DaysCounted++
+			if budgets[0].Remaining < 0 {
+				history.DaysOver++
+				totalOver -= budgets[0].Remaining
+			}
+		}
+		if history.DaysOver > 0 {
+			history.AverageOver = totalOver / history.DaysOver
+		}
+
+		result = append(result, history)
+	}
+
+	return result
+}
+
+func budgetHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	currentUser := currentUser(r)
+	categories, err := getCategories(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	timeline, err := getGoalTimeline(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	days, err := allDaysForUser(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	result := calcBudgetHistory(categories, *timeline, days)
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(result)
+	case mimeText:
+		for _, history := range result {
+			fmt.Fprintf(w, "%s\t%d/%d days over\t%d Cal average over\n", history.Category, history.DaysOver, history.DaysCounted, history.AverageOver)
+		}
+	}
+}
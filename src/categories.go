@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+type category struct {
+	ID            int
+	Name          string
+	DisplayOrder  int
+	Colour        string
+	Archived      bool
+	BudgetPercent float64
+	LastUsed      string
+}
+
+var errCategoryExists = errors.New("category already exists")
+var errCategoryNotFound = errors.New("category not found")
+
+var colourPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// execer is either the database or a transaction, so that categories can be
+// added as part of whatever wrote the entries using them.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// syncCategories adds a category row for any category that has been used on
+// a calorie entry but isn't yet tracked, which covers entries logged before
+// the category table existed. New entries add their own with addCategory.
+func syncCategories(username string) error {
+	_, err := database.Exec(`
+		INSERT INTO category (username, name, display_order, colour, archived, budget_percent)
+		SELECT DISTINCT e.username, e.category, 0, '', 0, 0 FROM calorie_entry e
+		WHERE e.username = ? AND e.category != ''
+		AND NOT EXISTS (SELECT 1 FROM category c WHERE c.username = e.username AND c.name = e.category)`, username)
+	return err
+}
+
+// syncAllCategories runs syncCategories for every user, once at startup, so
+// that reading categories never has to write.
+func syncAllCategories() error {
+	_, err := database.Exec(`
+		INSERT INTO category (username, name, display_order, colour, archived, budget_percent)
+		SELECT DISTINCT e.username, e.category, 0, '', 0, 0 FROM calorie_entry e
+		WHERE e.category != ''
+		AND NOT EXISTS (SELECT 1 FROM category c WHERE c.username = e.username AND c.name = e.category)`)
+	return err
+}
+
+// addCategory tracks a category when an entry is logged against it, if it
+// isn't already.
+func addCategory(db execer, name, username string) error {
+	if name == "" {
+		return nil
+	}
+	_, err := db.Exec(`
+		INSERT INTO category (username, name, display_order, colour, archived, budget_percent)
+		SELECT ?, ?, 0, '', 0, 0
+		WHERE NOT EXISTS (SELECT 1 FROM category WHERE username = ? AND name = ?)`, username, name, username, name)
+	return err
+}
+
+// getCategories returns all categories, archived or not, ordered first by their
+// display order and then by how recently they were used.
+func getCategories(username string) ([]category, error) {
+	rows, err := database.Query(`
+		SELECT c.id, c.name, c.display_order, c.colour, c.archived, c.budget_percent, COALESCE(u.last_used, '')
+		FROM category c LEFT JOIN (
+			SELECT category, MAX(date) AS last_used FROM calorie_entry WHERE username = ? GROUP BY category
+		) u ON u.category = c.name
+		WHERE c.username = ?
+		ORDER BY c.display_order, u.last_used DESC, c.name`, username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]category, 0)
+	for rows.Next() {
+		var c category
+		err = rows.Scan(&c.ID, &c.Name, &c.DisplayOrder, &c.Colour, &c.Archived, &c.BudgetPercent, &c.LastUsed)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+
+	return result, nil
+}
+
+func getCalorieCategories(username string) ([]string, error) {
+	categories, err := getCategories(username)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0)
+	for _, c := range categories {
+		if !c.Archived {
+			result = append(result, c.Name)
+		}
+	}
+
+	return result, nil
+}
+
+func updateCategory(c category, username string) error {
+	res, err := database.Exec("UPDATE category SET display_order = ?, colour = ?, archived = ?, budget_percent = ? WHERE name = ? AND username = ?",
+		c.DisplayOrder, c.Colour, c.Archived, c.BudgetPercent, c.Name, username)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err == nil && rows == 0 {
+		return errCategoryNotFound
+	}
+	return err
+}
+
+// renameCategory changes the name of a category, along with every calorie
+// entry and meal template entry that uses it. Renaming onto an existing
+// category is refused; that is what mergeCategories is for.
+func renameCategory(from, to, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkCategoryExists(tx, from, username, true); err != nil {
+		return err
+	}
+	if err = checkCategoryExists(tx, to, username, false); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE category SET name = ? WHERE name = ? AND username = ?", to, from, username); err != nil {
+		return err
+	}
+	if err = recategoriseEntries(tx, from, to, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// mergeCategories moves every entry from one category into another, then
+// removes the emptied category.
+func mergeCategories(from, into, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkCategoryExists(tx, from, username, true); err != nil {
+		return err
+	}
+	if err = checkCategoryExists(tx, into, username, true); err != nil {
+		return err
+	}
+
+	if err = recategoriseEntries(tx, from, into, username); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM category WHERE name = ? AND username = ?", from, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func checkCategoryExists(tx *sql.Tx, name, username string, shouldExist bool) error {
+	var count int
+	row := tx.QueryRow("SELECT COUNT(*) FROM category WHERE name = ? AND username = ?", name, username)
+	if err := row.Scan(&count); err != nil {
+		return err
+	}
+	if shouldExist && count == 0 {
+		return errCategoryNotFound
+	} else if !shouldExist && count != 0 {
+		return errCategoryExists
+	}
+	return nil
+}
+
+func recategoriseEntries(tx *sql.Tx, from, to, username string) error {
+	_, err := tx.Exec("UPDATE calorie_entry SET category = ? WHERE category = ? AND username = ?", to, from, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE meal_template_entry SET category = ? WHERE category = ?
+		AND template_id IN (SELECT id FROM meal_template WHERE username = ?)`, to, from, username)
+	return err
+}
+
+func categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	categories, err := getCalorieCategories(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(categories)
+	case mimeText:
+		for _, category := range categories {
+			fmt.Fprintln(w, category)
+		}
+	}
+}
+
+func allCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	categories, err := getCategories(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(categories)
+	case mimeText:
+		for _, c := range categories {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%g%%\n", c.DisplayOrder, c.Name, c.Colour, c.Archived, c.BudgetPercent)
+		}
+	}
+}
+
+// totalCategoryBudget adds up the budgets of active categories, which are
+// shares of a single daily allowance and so can't come to more than 100%.
+func totalCategoryBudget(categories []category) float64 {
+	result := 0.0
+	for _, c := range categories {
+		if !c.Archived {
+			result += c.BudgetPercent
+		}
+	}
+	return result
+}
+
+// updateCategoryHandler changes only the fields that are provided, so e.g.
+// archiving a category doesn't require resending its colour.
+func updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		invalidField(w, r, "name", "a category name is required")
+		return
+	}
+
+	currentUser := currentUser(r)
+	categories, err := getCategories(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	var existing *category
+	for i := range categories {
+		if categories[i].Name == name {
+			existing = &categories[i]
+		}
+	}
+	if existing == nil {
+		notFound(w, r)
+		return
+	}
+
+	var ok bool
+	if r.FormValue("display_order") != "" {
+		if existing.DisplayOrder, ok = formInt(r, "display_order"); !ok {
+			invalidField(w, r, "display_order", "display order must be a whole number")
+			return
+		}
+	}
+	if colour, set := r.Form["colour"]; set {
+		if colour[0] != "" && !colourPattern.MatchString(colour[0]) {
+			invalidField(w, r, "colour", "colour must be in the form #rrggbb")
+			return
+		}
+		existing.Colour = colour[0]
+	}
+	if r.FormValue("archived") != "" {
+		if existing.Archived, err = strconv.ParseBool(r.FormValue("archived")); err != nil {
+			invalidField(w, r, "archived", "archived must be true or false")
+			return
+		}
+	}
+	if r.FormValue("budget_percent") != "" {
+		if existing.BudgetPercent, ok = formFloat(r, "budget_percent"); !ok || existing.BudgetPercent < 0 {
+			invalidField(w, r, "budget_percent", "budget must be a number of at least 0")
+			return
+		}
+	}
+
+	if totalCategoryBudget(categories) > 100 {
+		invalidField(w, r, "budget_percent", "category budgets exceed 100%")
+		return
+	}
+
+	err = updateCategory(*existing, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func renameCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	from, to := r.FormValue("from"), r.FormValue("to")
+	if from == "" || to == "" || from == to {
+		badRequest(w, r, "two different category names are required", validationError{Field: "from", Message: "a category name is required"}, validationError{Field: "to", Message: "a different category name is required"})
+		return
+	}
+
+	currentUser := currentUser(r)
+	err := syncCategories(currentUser)
+	if err == nil {
+		err = renameCategory(from, to, currentUser)
+	}
+	writeCategoryChangeResult(w, r, err)
+}
+
+func mergeCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	from, into := r.FormValue("from"), r.FormValue("into")
+	if from == "" || into == "" || from == into {
+		badRequest(w, r, "two different category names are required", validationError{Field: "from", Message: "a category name is required"}, validationError{Field: "into", Message: "a different category name is required"})
+		return
+	}
+
+	currentUser := currentUser(r)
+	err := syncCategories(currentUser)
+	if err == nil {
+		err = mergeCategories(from, into, currentUser)
+	}
+	writeCategoryChangeResult(w, r, err)
+}
+
+func writeCategoryChangeResult(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errCategoryNotFound {
+		notFound(w, r)
+	} else if err == errCategoryExists {
+		writeError(w, r, http.StatusConflict, errorResponse{Code: codeConflict, Message: "category already exists, merge instead"})
+	} else if err != nil {
+		serverError(w, r, err)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Charts are drawn on the server so they look the same everywhere, including
+// outside the app. The data and layout are worked out once here, and each
+// output format only has to draw the lines, bars and labels it's given.
+//
+// Like the charts in the Hacker Diet, each recorded weight is joined to the
+// trend by a short line: a "sinker" below the trend is drawn in green, and a
+// "floater" above it in red.
+
+type chartOptions struct {
+	Width    int
+	Height   int
+	From     time.Time
+	To       time.Time
+	Calories bool
+}
+
+type chartPoint struct {
+	Date     time.Time
+	Recorded float64
+	Trend    float64
+	Calories int
+	Budget   int
+	Rung     int
+}
+
+type chartData struct {
+	Points      []chartPoint
+	Goal        float64
+	MinWeight   float64
+	MaxWeight   float64
+	MaxCalories int
+	Start       time.Time
+	End         time.Time
+}
+
+type chartColours struct {
+	Background string
+	Axis       string
+	Text       string
+	Recorded   string
+	Trend      string
+	Sinker     string
+	Floater    string
+	Goal       string
+	Calories   string
+}
+
+var chartTheme = chartColours{
+	Background: "#000000",
+	Axis:       "#888888",
+	Text:       "#ffffff",
+	Recorded:   "#ffffff",
+	Trend:      "#00ff00",
+	Sinker:     "#33cc33",
+	Floater:    "#ff3333",
+	Goal:       "#ffff00",
+	Calories:   "#334477",
+}
+
+// printTheme is for paper, where a black background would waste ink.
+var printTheme = chartColours{
+	Background: "#ffffff",
+	Axis:       "#bbbbbb",
+	Text:       "#000000",
+	Recorded:   "#000000",
+	Trend:      "#008800",
+	Sinker:     "#008800",
+	Floater:    "#cc0000",
+	Goal:       "#cc8800",
+	Calories:   "#c8d4ee",
+}
+
+// parseChartOptions reads the size and date range of a chart from the query,
+// defaulting to all of the user's history at 800 by 400.
+func parseChartOptions(r *http.Request) (chartOptions, bool) {
+	result := chartOptions{Width: 800, Height: 400, Calories: r.FormValue("calories") == "true"}
+
+	var ok bool
+	if r.FormValue("width") != "" {
+		if result.Width, ok = formInt(r, "width"); !ok || result.Width < 200 || result.Width > 4000 {
+			return result, false
+		}
+	}
+	if r.FormValue("height") != "" {
+		if result.Height, ok = formInt(r, "height"); !ok || result.Height < 100 || result.Height > 4000 {
+			return result, false
+		}
+	}
+
+	var err error
+	if from := r.FormValue("from"); from != "" {
+		if result.From, err = time.Parse("2006-01-02", from); err != nil {
+			return result, false
+		}
+	}
+	if to := r.FormValue("to"); to != "" {
+		if result.To, err = time.Parse("2006-01-02", to); err != nil {
+			return result, false
+		}
+		result.To = result.To.AddDate(0, 0, 1) // include the whole of the last day
+	}
+
+	return result, true
+}
+
+func (o chartOptions) inRange(date time.Time) bool {
+	return (o.From.IsZero() || !date.Before(o.From)) && (o.To.IsZero() || date.Before(o.To))
+}
+
+// buildChartData picks out the days within the range of the options. The
+// trend is calculated over all days first, so it is right from the very
+// start of the range.
+func buildChartData(days []recordedDay, timeline goalTimeline, options chartOptions) chartData {
+	result := chartData{Points: []chartPoint{}, MinWeight: math.MaxFloat64, MaxWeight: 0}
+	if timeline.current.Kind != "maintain" {
+		result.Goal = timeline.current.TargetWeight
+	}
+
+	trend := calcWeightTrend(days)
+	for i, day := range days {
+		date, err := time.Parse(time.RFC3339, day.Date)
+		if err != nil {
+			continue
+		}
+		if !options.inRange(date) {
+			continue
+		}
+
+		point := chartPoint{Date: date, Recorded: day.Weight, Trend: trend[i].Weighted, Rung: day.Rung}
+		for _, entry := range day.Entries {
+			point.Calories += entry.Amount
+		}
+		if dayMax := calcDayMax(timeline.on(date), day.Weight, date); dayMax != nil {
+			point.Budget = *dayMax
+		}
+		result.Points = append(result.Points, point)
+
+		result.MinWeight = math.Min(result.MinWeight, math.Min(point.Recorded, point.Trend))
+		result.MaxWeight = math.Max(result.MaxWeight, math.Max(point.Recorded, point.Trend))
+		if point.Calories > result.MaxCalories {
+			result.MaxCalories = point.Calories
+		}
+		if point.Budget > result.MaxCalories {
+			result.MaxCalories = point.Budget
+		}
+	}
+
+	if len(result.Points) == 0 {
+		result.MinWeight, result.MaxWeight = 0, 0
+		return result
+	}
+	if result.Goal != 0 {
+		result.MinWeight = math.Min(result.MinWeight, result.Goal)
+		result.MaxWeight = math.Max(result.MaxWeight, result.Goal)
+	}
+
+	// pad out to whole kilograms, so there is always some room around the lines
+	result.MinWeight = math.Floor(result.MinWeight - 0.5)
+	result.MaxWeight = math.Ceil(result.MaxWeight + 0.5)
+	result.Start = result.Points[0].Date
+	result.End = result.Points[len(result.Points)-1].Date
+	return result
+}
+
+// chartLayout positions the data within an image of a given size, leaving
+// margins for the axis labels. Calorie bars, when shown, rise from the bottom
+// of the plot to at most a quarter of its height.
+type chartLayout struct {
+	data     chartData
+	width    float64
+	height   float64
+	left     float64
+	right    float64
+	top      float64
+	bottom   float64
+	calories bool
+}
+
+func newChartLayout(data chartData, options chartOptions) chartLayout {
+	return chartLayout{
+		data:     data,
+		width:    float64(options.Width),
+		height:   float64(options.Height),
+		left:     50,
+		right:    float64(options.Width) - 10,
+		top:      10,
+		bottom:   float64(options.Height) - 30,
+		calories: options.Calories,
+	}
+}
+
+// x keeps the first and last days clear of the edges, so their bars fit.
+func (l chartLayout) x(date time.Time) float64 {
+	span := l.data.End.Sub(l.data.Start).Hours()
+	if span == 0 {
+		return (l.left + l.right) / 2
+	}
+	left, right := l.left+l.barWidth()/2+2, l.right-l.barWidth()/2-2
+	return left + (right-left)*date.Sub(l.data.Start).Hours()/span
+}
+
+func (l chartLayout) y(weight float64) float64 {
+	span := l.data.MaxWeight - l.data.MinWeight
+	if span == 0 {
+		return (l.top + l.bottom) / 2
+	}
+	return l.bottom - (l.bottom-l.top)*(weight-l.data.MinWeight)/span
+}
+
+func (l chartLayout) barHeight(calories int) float64 {
+	if !l.calories || l.data.MaxCalories == 0 {
+		return 0
+	}
+	return (l.bottom - l.top) / 4 * float64(calories) / float64(l.data.MaxCalories)
+}
+
+// calorieY is for charts of calories alone, which use the full height.
+func (l chartLayout) calorieY(calories int) float64 {
+	if l.data.MaxCalories == 0 {
+		return l.bottom
+	}
+	return l.bottom - (l.bottom-l.top)*float64(calories)/float64(l.data.MaxCalories)
+}
+
+// calorieTicks are every 500 calories, or 1000 for larger totals.
+func (l chartLayout) calorieTicks() []int {
+	step := 500
+	if l.data.MaxCalories > 5000 {
+		step = 1000
+	}
+	result := []int{}
+	for c := 0; c <= l.data.MaxCalories; c += step {
+		result = append(result, c)
+	}
+	return result
+}
+
+// barWidth leaves a small gap between the bars of neighbouring days.
+func (l chartLayout) barWidth() float64 {
+	days := l.data.End.Sub(l.data.Start).Hours()/24 + 1
+	return math.Min(40, math.Max(1, (l.right-l.left)/days*0.8))
+}
+
+// weightTicks are whole kilograms, spaced out so there are no more than ten.
+func (l chartLayout) weightTicks() []float64 {
+	step := math.Ceil((l.data.MaxWeight - l.data.MinWeight) / 10)
+	if step == 0 {
+		return nil
+	}
+	result := []float64{}
+	for w := l.data.MinWeight; w <= l.data.MaxWeight; w += step {
+		result = append(result, w)
+	}
+	return result
+}
+
+// dateTicks are evenly spaced along the x axis, about one per 120 pixels.
+func (l chartLayout) dateTicks() []time.Time {
+	count := int((l.right - l.left) / 120)
+	span := l.data.End.Sub(l.data.Start)
+	if count < 1 || span == 0 {
+		return []time.Time{l.data.Start}
+	}
+	result := []time.Time{}
+	for i := 0; i <= count; i++ {
+		result = append(result, l.data.Start.Add(span*time.Duration(i)/time.Duration(count)))
+	}
+	return result
+}
+
+// dateLabelX keeps date labels, which are centred on their tick, from
+// running off either side of the image.
+func (l chartLayout) dateLabelX(date time.Time) float64 {
+	return math.Max(l.left, math.Min(l.width-35, l.x(date)))
+}
+
+func (p chartPoint) sinkerColour(theme chartColours) string {
+	if p.Recorded > p.Trend {
+		return theme.Floater
+	}
+	return theme.Sinker
+}
+
+func formatTick(weight float64) string {
+	return strconv.FormatFloat(weight, 'f', -1, 64)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"log"
 	"sort"
 	"strconv"
 	"time"
@@ -36,19 +38,57 @@ func insertOrUpdateUser(user, pass string) error {
 	return err
 }
 
-func testAuthAgainstDB(user, pass string) (bool, error) {
-	var passwordHash string
+var errPasswordChanged = errors.New("password has been changed")
+
+// updatePassword replaces a user's password, unless it has been changed from
+// oldHash in the meantime, in which case errPasswordChanged is returned.
+func updatePassword(user, pass, oldHash string) error {
+	passwordHash, err := generateArgonHash(passwordConfig, pass)
+	if err != nil {
+		return err
+	}
 
+	res, err := database.Exec("UPDATE users SET password = ? WHERE username = ? AND password = ?", passwordHash, user, oldHash)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err == nil && rows == 0 {
+		err = errPasswordChanged
+	}
+	return err
+}
+
+func getPasswordHash(user string) (string, error) {
+	var passwordHash string
 	row := database.QueryRow("SELECT password FROM users WHERE username = ?", user)
 	err := row.Scan(&passwordHash)
+	return passwordHash, err
+}
 
+// testAuthAgainstDB checks a user's password, and if it's right but was hashed
+// with lower costs than passwordConfig now has, rehashes it. That way the
+// costs can be raised without anyone having to reset their password.
+func testAuthAgainstDB(user, pass string) (bool, error) {
+	passwordHash, err := getPasswordHash(user)
 	if err == sql.ErrNoRows {
 		return false, nil
 	} else if err != nil {
 		return false, err
-	} else {
-		return compareWithArgonHash(pass, passwordHash)
 	}
+
+	valid, err := compareWithArgonHash(pass, passwordHash)
+	if err != nil || !valid {
+		return false, err
+	}
+
+	// the password was right whether or not the rehash works
+	if argonHashIsWeaker(passwordHash, passwordConfig) {
+		if err = updatePassword(user, pass, passwordHash); err != nil {
+			log.Printf("ERROR: rehashing password for user %s: %s", user, err)
+		}
+	}
+	return valid, nil
 }
 
 func getSettings(username string) (map[string]string, error) {
@@ -72,7 +112,21 @@ func getSettings(username string) (map[string]string, error) {
 }
 
 func setSetting(key, val, username string) error {
-	res, err := database.Exec("UPDATE settings SET setting_value = ? WHERE setting_key = ? AND username = ?", val, key, username)
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = writeSetting(tx, key, val, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// writeSetting is setSetting as part of a larger transaction.
+func writeSetting(tx *sql.Tx, key, val, username string) error {
+	res, err := tx.Exec("UPDATE settings SET setting_value = ? WHERE setting_key = ? AND username = ?", val, key, username)
 	if err != nil {
 		return err
 	}
@@ -80,22 +134,50 @@ func setSetting(key, val, username string) error {
 	if err != nil || rows == 1 {
 		return err
 	}
-	_, err = database.Exec("INSERT INTO settings (setting_key, setting_value, username) VALUES (?, ?, ?)", key, val, username)
+	_, err = tx.Exec("INSERT INTO settings (setting_key, setting_value, username) VALUES (?, ?, ?)", key, val, username)
 	return err
 }
 
 type goals struct {
-	TargetWeight float64
-	TargetDate   string
-	BurnRate     int
+	TargetWeight    float64
+	TargetDate      string
+	BurnRate        int
+	IncludeExercise bool
+	Kind            string
+	Band            float64
 }
 
+// getGoals returns the active goal phase, or for users who haven't set a goal
+// since phases were introduced, the goal as it was stored in settings.
 func getGoals(username string) (*goals, error) {
 	settings, err := getSettings(username)
 	if err != nil {
 		return nil, err
 	}
 
+	includeExercise := false
+	includeExerciseVal, exists := settings["include_exercise"]
+	if exists {
+		includeExercise, err = strconv.ParseBool(includeExerciseVal)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	active, err := getActiveGoal(username)
+	if err != nil {
+		return nil, err
+	}
+	if active != nil {
+		if active.Kind == "maintain" && active.BurnRate == 0 {
+			active.BurnRate, err = maintenanceBurnRate(username)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &goals{active.TargetWeight, active.TargetDate, active.BurnRate, includeExercise, active.Kind, active.Band}, nil
+	}
+
 	var targetWeight float64
 	weightVal, exists := settings["target_weight"]
 	if exists {
@@ -116,43 +198,127 @@ func getGoals(username string) (*goals, error) {
 		}
 	}
 
-	return &goals{targetWeight, date, burnRate}, nil
+	return &goals{targetWeight, date, burnRate, includeExercise, "cut", 0}, nil
+}
+
+type weightEntry struct {
+	ID     int
+	Date   string
+	Weight float64
 }
 
-func addWeightEntry(day time.Time, val float64, username string) error {
+func addWeightEntry(day time.Time, val float64, username string) (int, error) {
 	date := day.Format(time.RFC3339)
-	_, err := database.Exec("INSERT INTO weight_entry (date, weight, username) VALUES (?, ?, ?)", date, val, username)
-	return err
+	res, err := database.Exec("INSERT INTO weight_entry (date, weight, username) VALUES (?, ?, ?)", date, val, username)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
 }
 
-func getCalorieCategories(username string) ([]string, error) {
-	rows, err := database.Query("SELECT DISTINCT category FROM calorie_entry WHERE username = ?", username)
-	defer rows.Close()
+// recordWeight adds a weight, then checks whether the trend it leaves has
+// finished the current goal.
+func recordWeight(day time.Time, val float64, username string) (int, error) {
+	id, err := addWeightEntry(day, val, username)
+	if err != nil {
+		return 0, err
+	}
+	trend, err := getTrendOn(day, username)
+	if err != nil {
+		return id, err
+	}
+	return id, updateGoalProgress(trend, day, username)
+}
+
+func getWeightEntries(username string) ([]weightEntry, error) {
+	rows, err := database.Query("SELECT id, date, weight FROM weight_entry WHERE username = ? ORDER BY date", username)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	result := make([]string, 0)
+	result := make([]weightEntry, 0)
 	for rows.Next() {
-		var val string
-		err = rows.Scan(&val)
+		var entry weightEntry
+		err = rows.Scan(&entry.ID, &entry.Date, &entry.Weight)
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, val)
+		result = append(result, entry)
 	}
 
 	return result, nil
 }
 
-func addCalorieEntry(day time.Time, amount int, category, username string) error {
-	date := day.Format(time.RFC3339)
-	_, err := database.Exec("INSERT INTO calorie_entry (date, amount, category, username) VALUES (?, ?, ?, ?)", date, amount, category, username)
+func getWeightEntry(id int, username string) (weightEntry, error) {
+	var entry weightEntry
+	row := database.QueryRow("SELECT id, date, weight FROM weight_entry WHERE id = ? AND username = ?", id, username)
+	err := row.Scan(&entry.ID, &entry.Date, &entry.Weight)
+	return entry, err
+}
+
+func deleteWeightEntry(id int, username string) error {
+	_, err := database.Exec("DELETE FROM weight_entry WHERE id = ? AND username = ?", id, username)
 	return err
 }
 
+func addCalorieEntry(day time.Time, amount int, category, username string) (int, error) {
+	date := day.Format(time.RFC3339)
+	res, err := database.Exec("INSERT INTO calorie_entry (date, amount, category, username) VALUES (?, ?, ?, ?)", date, amount, category, username)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), addCategory(database, category, username)
+}
+
+// datedCalorieEntry is a calorie entry along with when it was recorded, for
+// when it isn't already known from the day being looked at.
+type datedCalorieEntry struct {
+	Date string
+	calorieEntry
+}
+
+func getCalorieEntry(id int, username string) (datedCalorieEntry, error) {
+	var entry datedCalorieEntry
+	row := database.QueryRow("SELECT id, date, amount, category, COALESCE(recipe_id, 0) FROM calorie_entry WHERE id = ? AND username = ?", id, username)
+	err := row.Scan(&entry.ID, &entry.Date, &entry.Amount, &entry.Category, &entry.RecipeID)
+	return entry, err
+}
+
+func getDatedCalories(day time.Time, username string) ([]datedCalorieEntry, error) {
+	start, end := getDayStartAndEnd(day)
+
+	rows, err := database.Query("SELECT id, date, amount, category, COALESCE(recipe_id, 0) FROM calorie_entry WHERE date >= ? AND date <= ? AND username = ? ORDER BY date", start, end, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]datedCalorieEntry, 0)
+	for rows.Next() {
+		var entry datedCalorieEntry
+		err = rows.Scan(&entry.ID, &entry.Date, &entry.Amount, &entry.Category, &entry.RecipeID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
 func deleteCalorieEntry(id int, username string) error {
 	_, err := database.Exec("DELETE FROM calorie_entry WHERE Id = ? AND username = ?", id, username)
+	if err != nil {
+		return err
+	}
+	// drinks are logged with a calorie entry, and shouldn't outlive it
+	_, err = database.Exec("DELETE FROM drink_entry WHERE calorie_entry_id = ? AND username = ?", id, username)
 	return err
 }
 
@@ -198,12 +364,13 @@ type calorieEntry struct {
 	ID       int
 	Amount   int
 	Category string
+	RecipeID int
 }
 
 func getDayCalories(day time.Time, username string) ([]calorieEntry, error) {
 	start, end := getDayStartAndEnd(day)
 
-	rows, err := database.Query("SELECT id, amount, category FROM calorie_entry WHERE date >= ? AND date <= ? AND username = ?", start, end, username)
+	rows, err := database.Query("SELECT id, amount, category, COALESCE(recipe_id, 0) FROM calorie_entry WHERE date >= ? AND date <= ? AND username = ?", start, end, username)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -212,7 +379,7 @@ func getDayCalories(day time.Time, username string) ([]calorieEntry, error) {
 	result := make([]calorieEntry, 0)
 	for rows.Next() {
 		var row calorieEntry
-		err = rows.Scan(&row.ID, &row.Amount, &row.Category)
+		err = rows.Scan(&row.ID, &row.Amount, &row.Category, &row.RecipeID)
 		if err != nil {
 			return nil, err
 		}
@@ -223,19 +390,38 @@ func getDayCalories(day time.Time, username string) ([]calorieEntry, error) {
 }
 
 func clearAllEntries(username string) error {
-	_, err := database.Exec("delete from settings WHERE username = ?", username)
+	tx, err := database.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = database.Exec("delete from weight_entry WHERE username = ?", username)
-	if err != nil {
-		return err
+	defer tx.Rollback()
+
+	// ingredients and template entries belong to the user through their
+	// recipe and template, so go before them
+	statements := []string{
+		"delete from settings WHERE username = ?",
+		"delete from weight_entry WHERE username = ?",
+		"delete from calorie_entry WHERE username = ?",
+		"delete from recipe_ingredient WHERE recipe_id IN (SELECT id FROM recipe WHERE username = ?)",
+		"delete from recipe WHERE username = ?",
+		"delete from food WHERE username = ?",
+		"delete from meal_template_entry WHERE template_id IN (SELECT id FROM meal_template WHERE username = ?)",
+		"delete from meal_template WHERE username = ?",
+		"delete from category WHERE username = ?",
+		"delete from exercise_entry WHERE username = ?",
+		"delete from rung_entry WHERE username = ?",
+		"delete from drink_entry WHERE username = ?",
+		"delete from intake_entry WHERE username = ?",
+		"delete from body_measurement WHERE username = ?",
+		"delete from goal WHERE username = ?",
+		"delete from achievement WHERE username = ?",
 	}
-	_, err = database.Exec("delete from calorie_entry WHERE username = ?", username)
-	if err != nil {
-		return err
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement, username); err != nil {
+			return err
+		}
 	}
-	return nil
+	return tx.Commit()
 }
 
 type recordedDay struct {
@@ -243,6 +429,8 @@ type recordedDay struct {
 	Weight  float64
 	Entries []calorieEntry
 	Total   int
+	Rung    int
+	Intake  map[string]float64 `json:",omitempty"`
 }
 
 func allDaysForUser(username string) ([]recordedDay, error) {
@@ -253,10 +441,75 @@ func allDaysForUser(username string) ([]recordedDay, error) {
 	}
 
 	days, err = appendEntriesToDays(username, days)
+	if err != nil {
+		return nil, err
+	}
+
+	days, err = appendRungsToDays(username, days)
+	if err != nil {
+		return nil, err
+	}
+
+	days, err = appendIntakeToDays(username, days)
+	if err != nil {
+		return nil, err
+	}
 
 	return sortDays(days), nil
 }
 
+// calorieDaysForUser returns every day with calories logged, whether or not
+// there was a weigh-in that day, for breakdowns of what was eaten. A day
+// without one carries the last weight recorded before it, so its budget can
+// still be worked out.
+func calorieDaysForUser(username string) ([]recordedDay, error) {
+	rows, err := database.Query("SELECT date FROM calorie_entry WHERE username = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make(map[string]recordedDay)
+	for rows.Next() {
+		var date string
+		err = rows.Scan(&date)
+		if err != nil {
+			return nil, err
+		}
+
+		dateVal, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			return nil, err
+		}
+
+		start, _ := getDayStartAndEnd(dateVal)
+		days[start] = recordedDay{start, 0, []calorieEntry{}, 0, 0, nil}
+	}
+
+	days, err = appendEntriesToDays(username, days)
+	if err != nil {
+		return nil, err
+	}
+
+	weights, err := createDaysFromWeights(username)
+	if err != nil {
+		return nil, err
+	}
+
+	weighIns := sortDays(weights)
+	result := sortDays(days)
+	latest, next := 0.0, 0
+	for i := range result {
+		for next < len(weighIns) && weighIns[next].Date <= result[i].Date {
+			latest = weighIns[next].Weight
+			next++
+		}
+		result[i].Weight = latest
+	}
+
+	return result, nil
+}
+
 func createDaysFromWeights(username string) (map[string]recordedDay, error) {
 	weightRows, err := database.Query("SELECT weight, date FROM weight_entry WHERE username = ? ORDER BY date", username)
 	defer weightRows.Close()
@@ -279,24 +532,23 @@ func createDaysFromWeights(username string) (map[string]recordedDay, error) {
 		}
 
 		start, _ := getDayStartAndEnd(dateVal)
-		days[start] = recordedDay{start, weight, []calorieEntry{}, 0}
+		days[start] = recordedDay{start, weight, []calorieEntry{}, 0, 0, nil}
 	}
 
 	return days, nil
 }
 
 func appendEntriesToDays(username string, days map[string]recordedDay) (map[string]recordedDay, error) {
-	caloryRows, err := database.Query("SELECT id, amount, category, date FROM calorie_entry WHERE username = ? ORDER BY date", username)
+	caloryRows, err := database.Query("SELECT id, amount, category, COALESCE(recipe_id, 0), date FROM calorie_entry WHERE username = ? ORDER BY date", username)
 	defer caloryRows.Close()
 	if err != nil {
 		return nil, err
 	}
 
 	for caloryRows.Next() {
-		var id int
-		var amount int
+		var id, amount, recipeID int
 		var category, date string
-		err = caloryRows.Scan(&id, &amount, &category, &date)
+		err = caloryRows.Scan(&id, &amount, &category, &recipeID, &date)
 		if err != nil {
 			return nil, err
 		}
@@ -311,7 +563,7 @@ func appendEntriesToDays(username string, days map[string]recordedDay) (map[stri
 		if !exists {
 			continue
 		}
-		entry.Entries = append(entry.Entries, calorieEntry{id, amount, category})
+		entry.Entries = append(entry.Entries, calorieEntry{id, amount, category, recipeID})
 		days[start] = entry
 	}
 
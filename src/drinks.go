@@ -0,0 +1,411 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultDrinksCategory = "Drinks"
+
+// defaults for NZ/AU standard drinks and guidance, overridable in settings
+const defaultStandardDrinkGrams = 10.0
+const defaultWeeklyUnitLimit = 10.0
+
+const ethanolDensity = 0.789 // grams per ml
+const ethanolCalories = 7.0  // per gram
+
+// drinkTypes holds the rough calories per ml that come from sugars and other
+// carbohydrates rather than the alcohol itself.
+var drinkTypes = map[string]float64{
+	"beer":     0.15,
+	"cider":    0.25,
+	"wine":     0.17,
+	"spirits":  0.0,
+	"cocktail": 0.6,
+	"other":    0.1,
+}
+
+type drinkEntry struct {
+	ID             int
+	Date           string
+	DrinkType      string
+	Volume         float64
+	ABV            float64
+	Units          float64
+	CalorieEntryID int
+}
+
+type drinkWeek struct {
+	WeekStart    string
+	Units        float64
+	DrinkingDays int
+}
+
+type drinksSummary struct {
+	WeekStart                string
+	WeekUnits                float64
+	WeeklyLimit              float64
+	RemainingUnits           float64
+	AlcoholFreeStreak        int
+	LongestAlcoholFreeStreak int
+	Weeks                    []drinkWeek
+}
+
+// calcDrink returns the standard units and calories in a drink of volume ml
+// at the given percentage alcohol by volume.
+func calcDrink(drinkType string, volume, abv, standardDrinkGrams float64) (float64, int) {
+	grams := volume * abv / 100 * ethanolDensity
+	units := math.Round(grams/standardDrinkGrams*10) / 10
+	calories := grams*ethanolCalories + volume*drinkTypes[drinkType]
+	return units, int(math.Round(calories))
+}
+
+func getDrinkSettings(username string) (standardDrinkGrams, weeklyLimit float64, err error) {
+	settings, err := getSettings(username)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	standardDrinkGrams, weeklyLimit = defaultStandardDrinkGrams, defaultWeeklyUnitLimit
+	if val, exists := settings["standard_drink_grams"]; exists {
+		if standardDrinkGrams, err = strconv.ParseFloat(val, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	if val, exists := settings["weekly_unit_limit"]; exists {
+		if weeklyLimit, err = strconv.ParseFloat(val, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	return standardDrinkGrams, weeklyLimit, nil
+}
+
+// getDrinksCategory returns the category drinks are logged under, which is
+// wherever the last drink's calories now are, so that it follows the category
+// through a rename or merge. The first drink goes under "Drinks".
+func getDrinksCategory(tx *sql.Tx, username string) (string, error) {
+	var category string
+	row := tx.QueryRow(`
+		SELECT c.category FROM drink_entry d JOIN calorie_entry c ON c.id = d.calorie_entry_id
+		WHERE d.username = ? ORDER BY d.date DESC, d.id DESC LIMIT 1`, username)
+	err := row.Scan(&category)
+	if err == sql.ErrNoRows {
+		return defaultDrinksCategory, nil
+	}
+	return category, err
+}
+
+// addDrinkEntry records the drink along with a matching calorie entry, so that
+// drinks count against the daily allowance like anything else consumed.
+func addDrinkEntry(day time.Time, entry drinkEntry, calories int, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	category, err := getDrinksCategory(tx, username)
+	if err != nil {
+		return err
+	}
+
+	date := day.Format(time.RFC3339)
+	res, err := tx.Exec("INSERT INTO calorie_entry (date, amount, category, username) VALUES (?, ?, ?, ?)", date, calories, category, username)
+	if err != nil {
+		return err
+	}
+	calorieID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err = addCategory(tx, category, username); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO drink_entry (date, drink_type, volume, abv, units, calorie_entry_id, username) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		date, entry.DrinkType, entry.Volume, entry.ABV, entry.Units, calorieID, username)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func deleteDrinkEntry(id int, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM calorie_entry WHERE id = (SELECT calorie_entry_id FROM drink_entry WHERE id = ? AND username = ?) AND username = ?", id, username, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM drink_entry WHERE id = ? AND username = ?", id, username)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func getDrinkEntries(username string) ([]drinkEntry, error) {
+	rows, err := database.Query("SELECT id, date, drink_type, volume, abv, units, calorie_entry_id FROM drink_entry WHERE username = ? ORDER BY date", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]drinkEntry, 0)
+	for rows.Next() {
+		var entry drinkEntry
+		err = rows.Scan(&entry.ID, &entry.Date, &entry.DrinkType, &entry.Volume, &entry.ABV, &entry.Units, &entry.CalorieEntryID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+func getDayDrinks(day time.Time, username string) ([]drinkEntry, error) {
+	start, end := getDayStartAndEnd(day)
+
+	rows, err := database.Query("SELECT id, date, drink_type, volume, abv, units, calorie_entry_id FROM drink_entry WHERE date >= ? AND date <= ? AND username = ? ORDER BY date", start, end, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]drinkEntry, 0)
+	for rows.Next() {
+		var entry drinkEntry
+		err = rows.Scan(&entry.ID, &entry.Date, &entry.DrinkType, &entry.Volume, &entry.ABV, &entry.Units, &entry.CalorieEntryID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+func weekStart(day time.Time) time.Time {
+	y, m, d := day.Date()
+	offset := (int(day.Weekday()) + 6) % 7 // weeks start on monday
+	return time.Date(y, m, d-offset, 0, 0, 0, 0, day.Location())
+}
+
+// calcDrinksSummary totals units per week and counts alcohol-free days, from
+// the first drink logged up until today.
+func calcDrinksSummary(entries []drinkEntry, weeklyLimit float64, today time.Time) drinksSummary {
+	thisWeek := weekStart(today).Format("2006-01-02")
+	summary := drinksSummary{WeekStart: thisWeek, WeeklyLimit: weeklyLimit, RemainingUnits: weeklyLimit, Weeks: []drinkWeek{}}
+	if len(entries) == 0 {
+		return summary
+	}
+
+	drinkingDays := make(map[string]bool)
+	for _, entry := range entries {
+		day := entry.Date[:10]
+		date, err := time.ParseInLocation("2006-01-02", day, today.Location())
+		if err != nil {
+			continue
+		}
+		week := weekStart(date).Format("2006-01-02")
+
+		if len(summary.Weeks) == 0 || summary.Weeks[len(summary.Weeks)-1].WeekStart != week {
+			summary.Weeks = append(summary.Weeks, drinkWeek{WeekStart: week})
+		}
+		current := &summary.Weeks[len(summary.Weeks)-1]
+		current.Units = math.Round((current.Units+entry.Units)*10) / 10
+		// a zero-unit drink (alcohol-free beer, say) doesn't break a dry day
+		if entry.Units > 0 && !drinkingDays[day] {
+			current.DrinkingDays++
+			drinkingDays[day] = true
+		}
+	}
+
+	last := summary.Weeks[len(summary.Weeks)-1]
+	if last.WeekStart == thisWeek {
+		summary.WeekUnits = last.Units
+		summary.RemainingUnits = math.Round((weeklyLimit-last.Units)*10) / 10
+	}
+
+	first, _ := time.ParseInLocation("2006-01-02", entries[0].Date[:10], today.Location())
+	end := today.Format("2006-01-02")
+	streak := 0
+	for day := first; day.Format("2006-01-02") <= end; day = day.AddDate(0, 0, 1) {
+		if drinkingDays[day.Format("2006-01-02")] {
+			streak = 0
+			continue
+		}
+		streak++
+		if streak > summary.LongestAlcoholFreeStreak {
+			summary.LongestAlcoholFreeStreak = streak
+		}
+	}
+	summary.AlcoholFreeStreak = streak
+
+	return summary
+}
+
+func addDrinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	entry := drinkEntry{DrinkType: r.FormValue("drink_type")}
+	if _, exists := drinkTypes[entry.DrinkType]; !exists {
+		invalidField(w, r, "drink_type", "unknown drink type")
+		return
+	}
+
+	var ok bool
+	if entry.Volume, ok = formFloat(r, "volume"); !ok || entry.Volume <= 0 {
+		invalidField(w, r, "volume", "volume must be a number greater than 0")
+		return
+	}
+	if entry.ABV, ok = formFloat(r, "abv"); !ok || entry.ABV < 0 || entry.ABV > 100 {
+		invalidField(w, r, "abv", "abv must be between 0 and 100")
+		return
+	}
+
+	currentUser := currentUser(r)
+	standardDrinkGrams, _, err := getDrinkSettings(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	var calories int
+	entry.Units, calories = calcDrink(entry.DrinkType, entry.Volume, entry.ABV, standardDrinkGrams)
+
+	err = addDrinkEntry(time.Now(), entry, calories, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func drinksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	day := time.Now()
+	if date := r.FormValue("date"); date != "" {
+		var err error
+		day, err = time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			invalidField(w, r, "date", "date must be in the form yyyy-mm-dd")
+			return
+		}
+	}
+
+	entries, err := getDayDrinks(day, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(entries)
+	case mimeText:
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%d\t%s\t%g ml\t%g%%\t%g units\n", entry.ID, entry.DrinkType, entry.Volume, entry.ABV, entry.Units)
+		}
+	}
+}
+
+func deleteDrinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	err := deleteDrinkEntry(id, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func drinksSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	currentUser := currentUser(r)
+	for _, key := range []string{"weekly_unit_limit", "standard_drink_grams"} {
+		if r.FormValue(key) == "" {
+			continue
+		}
+		val, ok := formFloat(r, key)
+		if !ok || val <= 0 {
+			invalidField(w, r, key, "value must be a number greater than 0")
+			return
+		}
+		err := setSetting(key, strconv.FormatFloat(val, 'f', -1, 64), currentUser)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func drinksSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	currentUser := currentUser(r)
+	_, weeklyLimit, err := getDrinkSettings(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	entries, err := getDrinkEntries(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	summary := calcDrinksSummary(entries, weeklyLimit, time.Now())
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(summary)
+	case mimeText:
+		fmt.Fprintf(w, "%g / %g units this week\n", summary.WeekUnits, summary.WeeklyLimit)
+		fmt.Fprintf(w, "%d alcohol free days (longest %d)\n", summary.AlcoholFreeStreak, summary.LongestAlcoholFreeStreak)
+		for _, week := range summary.Weeks {
+			fmt.Fprintf(w, "%s\t%g units\t%d days\n", week.WeekStart, week.Units, week.DrinkingDays)
+		}
+	}
+}
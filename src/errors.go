@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// Every failure is reported the same way, as JSON with a code that clients
+// can act on, a message for people, and when the problem is with the input,
+// which fields were at fault. Each request is given an id, returned in the
+// X-Request-ID header and in errors, and logged alongside internal errors so
+// that a report from a user can be matched up with the log.
+
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeValidationFailed     = "validation_failed"
+	codeUnauthorised         = "unauthorised"
+	codeSecondFactorRequired = "second_factor_required"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeNotAcceptable        = "not_acceptable"
+	codeConflict             = "conflict"
+	codeTooManyRequests      = "too_many_requests"
+	codeServerError          = "server_error"
+)
+
+type validationError struct {
+	Field      string
+	Message    string
+	Suggestion string `json:",omitempty"`
+}
+
+type errorResponse struct {
+	Code      string
+	Message   string
+	Fields    []validationError `json:",omitempty"`
+	RequestID string            `json:",omitempty"`
+}
+
+type requestIDKey struct{}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID()
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// withRecovery turns a panic in any handler into a 500 for that request,
+// rather than the whole server going down with it.
+func withRecovery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			serverError(w, r, fmt.Errorf("panic: %v\n%s", recovered, debug.Stack()))
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, e errorResponse) {
+	e.RequestID = requestID(r)
+	headers := w.Header()
+	headers.Del("Content-Disposition")
+	headers.Set("Content-Type", mimeJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// badRequest is for input that can't be used, optionally naming the fields
+// that were at fault.
+func badRequest(w http.ResponseWriter, r *http.Request, message string, fields ...validationError) {
+	writeError(w, r, http.StatusBadRequest, errorResponse{Code: codeInvalidRequest, Message: message, Fields: fields})
+}
+
+// invalidField is a badRequest for a single form field.
+func invalidField(w http.ResponseWriter, r *http.Request, field, message string) {
+	badRequest(w, r, message, validationError{Field: field, Message: message})
+}
+
+// validationFailed is for input that is well formed, but not allowed.
+func validationFailed(w http.ResponseWriter, r *http.Request, message string, fields []validationError) {
+	writeError(w, r, http.StatusUnprocessableEntity, errorResponse{Code: codeValidationFailed, Message: message, Fields: fields})
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "not found"})
+}
+
+func logError(r *http.Request, err error) {
+	log.Println("ERROR [" + requestID(r) + "]: " + err.Error())
+}
+
+// serverError logs the details of an internal error, which aren't for the
+// client, and returns only the request id to find them by.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	logError(r, err)
+	writeError(w, r, http.StatusInternalServerError, errorResponse{Code: codeServerError, Message: "server error, reference " + requestID(r)})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type exerciseEntry struct {
+	ID       int
+	Activity string
+	Duration int
+	Calories int
+}
+
+// metTable holds rough metabolic equivalents for common activities, from the
+// Compendium of Physical Activities. 1 MET is the energy used sitting still.
+var metTable = map[string]float64{
+	"walking":         3.5,
+	"brisk walking":   4.3,
+	"hiking":          6.0,
+	"jogging":         7.0,
+	"running":         9.8,
+	"cycling":         7.5,
+	"swimming":        6.0,
+	"rowing":          7.0,
+	"elliptical":      5.0,
+	"weight training": 5.0,
+	"yoga":            2.5,
+	"dancing":         5.0,
+	"gardening":       3.8,
+	"tennis":          7.3,
+	"football":        7.0,
+	"climbing":        8.0,
+}
+
+// calcExerciseBurn estimates the calories burned by an activity over and above
+// resting, as the resting portion is already part of the daily burn rate.
+func calcExerciseBurn(activity string, minutes int, weight float64) (int, bool) {
+	met, exists := metTable[activity]
+	if !exists || weight == 0 {
+		return 0, false
+	}
+	return int(math.Round((met - 1) * weight * float64(minutes) / 60)), true
+}
+
+func addExerciseEntry(day time.Time, entry exerciseEntry, username string) error {
+	date := day.Format(time.RFC3339)
+	_, err := database.Exec("INSERT INTO exercise_entry (date, activity, duration, calories, username) VALUES (?, ?, ?, ?, ?)",
+		date, entry.Activity, entry.Duration, entry.Calories, username)
+	return err
+}
+
+func deleteExerciseEntry(id int, username string) error {
+	_, err := database.Exec("DELETE FROM exercise_entry WHERE id = ? AND username = ?", id, username)
+	return err
+}
+
+func getDayExercise(day time.Time, username string) ([]exerciseEntry, error) {
+	start, end := getDayStartAndEnd(day)
+
+	rows, err := database.Query("SELECT id, activity, duration, calories FROM exercise_entry WHERE date >= ? AND date <= ? AND username = ?", start, end, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]exerciseEntry, 0)
+	for rows.Next() {
+		var row exerciseEntry
+		err = rows.Scan(&row.ID, &row.Activity, &row.Duration, &row.Calories)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+
+	return result, nil
+}
+
+func totalExerciseBurn(entries []exerciseEntry) int {
+	total := 0
+	for _, entry := range entries {
+		total += entry.Calories
+	}
+	return total
+}
+
+func addExerciseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	entry := exerciseEntry{Activity: r.FormValue("activity")}
+	if entry.Activity == "" {
+		invalidField(w, r, "activity", "an activity is required")
+		return
+	}
+
+	var ok bool
+	if entry.Duration, ok = formInt(r, "duration"); !ok || entry.Duration <= 0 {
+		invalidField(w, r, "duration", "duration must be a whole number of minutes greater than 0")
+		return
+	}
+
+	currentUser := currentUser(r)
+
+	// an explicit figure (e.g. from a fitness tracker) beats the estimate
+	if r.FormValue("calories") != "" {
+		if entry.Calories, ok = formInt(r, "calories"); !ok || entry.Calories < 0 {
+			invalidField(w, r, "calories", "calories must be a whole number of at least 0")
+			return
+		}
+	} else {
+		weight, err := getLatestWeight(currentUser)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if entry.Calories, ok = calcExerciseBurn(entry.Activity, entry.Duration, weight); !ok {
+			invalidField(w, r, "calories", "unknown activity or no weight recorded, calories required")
+			return
+		}
+	}
+
+	err := addExerciseEntry(time.Now(), entry, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func exerciseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	day := time.Now()
+	if date := r.FormValue("date"); date != "" {
+		var err error
+		day, err = time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			invalidField(w, r, "date", "date must be in the form yyyy-mm-dd")
+			return
+		}
+	}
+
+	entries, err := getDayExercise(day, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(entries)
+	case mimeText:
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%d\t%s\t%d min\t%d Cal\n", entry.ID, entry.Activity, entry.Duration, entry.Calories)
+		}
+	}
+}
+
+func deleteExerciseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	err := deleteExerciseEntry(id, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func activitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	activities := make([]string, 0, len(metTable))
+	for activity := range metTable {
+		activities = append(activities, activity)
+	}
+	sort.Strings(activities)
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(metTable)
+	case mimeText:
+		for _, activity := range activities {
+			fmt.Fprintf(w, "%s\t%g\n", activity, metTable[activity])
+		}
+	}
+}
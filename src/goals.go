@@ -0,0 +1,502 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Goals are kept as a series of phases, e.g. a cut down to a target weight
+// followed by a period of maintenance. Only one phase is active at a time;
+// planned phases are queued up behind it and started in order as each one
+// finishes, and finished phases are kept so past goals can be looked back on.
+
+var goalKinds = map[string]bool{"cut": true, "maintain": true, "bulk": true}
+
+const (
+	goalPlanned  = "planned"
+	goalActive   = "active"
+	goalAchieved = "achieved"
+	goalMissed   = "missed"
+	goalReplaced = "replaced"
+)
+
+type goalPhase struct {
+	ID           int
+	Kind         string
+	Status       string
+	StartDate    string
+	StartWeight  float64
+	TargetWeight float64
+	TargetDate   string
+	BurnRate     int
+	Band         float64
+	EndDate      string
+}
+
+const goalColumns = "id, kind, status, start_date, start_weight, target_weight, target_date, burn_rate, band, end_date"
+
+func scanGoalPhase(scan func(dest ...interface{}) error) (goalPhase, error) {
+	var g goalPhase
+	err := scan(&g.ID, &g.Kind, &g.Status, &g.StartDate, &g.StartWeight, &g.TargetWeight, &g.TargetDate, &g.BurnRate, &g.Band, &g.EndDate)
+	return g, err
+}
+
+func getActiveGoal(username string) (*goalPhase, error) {
+	row := database.QueryRow("SELECT "+goalColumns+" FROM goal WHERE status = ? AND username = ?", goalActive, username)
+	g, err := scanGoalPhase(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func getGoalPhases(username string) ([]goalPhase, error) {
+	rows, err := database.Query("SELECT "+goalColumns+" FROM goal WHERE username = ? ORDER BY sequence", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]goalPhase, 0)
+	for rows.Next() {
+		g, err := scanGoalPhase(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, g)
+	}
+
+	return result, nil
+}
+
+func insertGoalPhase(tx *sql.Tx, g goalPhase, username string) (int, error) {
+	res, err := tx.Exec(`
+		INSERT INTO goal (kind, status, start_date, start_weight, target_weight, target_date, burn_rate, band, end_date, sequence, username)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, '', (SELECT COALESCE(MAX(sequence), 0) + 1 FROM goal WHERE username = ?), ?)`,
+		g.Kind, g.Status, g.StartDate, g.StartWeight, g.TargetWeight, g.TargetDate, g.BurnRate, g.Band, username, username)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// setActiveGoal replaces the current phase with a new one, starting now. The
+// old phase is kept in the history as replaced.
+func setActiveGoal(g goalPhase, day time.Time, startWeight float64, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE goal SET status = ?, end_date = ? WHERE status = ? AND username = ?", goalReplaced, day.Format("2006-01-02"), goalActive, username)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		if err = migrateLegacyGoal(tx, day, username); err != nil {
+			return err
+		}
+	}
+
+	g.Status, g.StartDate, g.StartWeight = goalActive, day.Format("2006-01-02"), startWeight
+	if _, err = insertGoalPhase(tx, g, username); err != nil {
+		return err
+	}
+
+	// goals used to live in settings, and would otherwise linger there
+	_, err = tx.Exec("DELETE FROM settings WHERE setting_key IN ('target_weight', 'target_date', 'daily_burn_rate') AND username = ?", username)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migrateLegacyGoal keeps a goal from before phases were introduced, which
+// lived in settings, as a replaced phase so it isn't lost from the history.
+// It is taken to have started with the first recorded weight.
+func migrateLegacyGoal(tx *sql.Tx, day time.Time, username string) error {
+	rows, err := tx.Query("SELECT setting_key, setting_value FROM settings WHERE setting_key IN ('target_weight', 'target_date', 'daily_burn_rate') AND username = ?", username)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+	for rows.Next() {
+		var key, val string
+		if err = rows.Scan(&key, &val); err != nil {
+			return err
+		}
+		settings[key] = val
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if len(settings) == 0 {
+		return nil
+	}
+
+	// values that no longer parse are left at zero rather than blocking the
+	// new goal that replaces them
+	g := goalPhase{Kind: "cut", Status: goalReplaced, TargetDate: settings["target_date"]}
+	g.TargetWeight, _ = strconv.ParseFloat(settings["target_weight"], 64)
+	g.BurnRate, _ = strconv.Atoi(settings["daily_burn_rate"])
+
+	var firstDate string
+	row := tx.QueryRow("SELECT date, weight FROM weight_entry WHERE username = ? ORDER BY date LIMIT 1", username)
+	err = row.Scan(&firstDate, &g.StartWeight)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if len(firstDate) >= 10 {
+		g.StartDate = firstDate[:10]
+	}
+
+	id, err := insertGoalPhase(tx, g, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE goal SET end_date = ? WHERE id = ?", day.Format("2006-01-02"), id)
+	return err
+}
+
+// goalTimeline works out which goal was in effect on a given day, so past
+// days are judged by the budget they had at the time rather than today's.
+type goalTimeline struct {
+	current             goals
+	phases              []goalPhase
+	maintenanceBurnRate int
+}
+
+func getGoalTimeline(username string) (*goalTimeline, error) {
+	current, err := getGoals(username)
+	if err != nil {
+		return nil, err
+	}
+
+	phases, err := getGoalPhases(username)
+	if err != nil {
+		return nil, err
+	}
+
+	result := goalTimeline{current: *current, phases: phases}
+	for _, g := range phases {
+		if g.Kind == "maintain" && g.BurnRate == 0 {
+			result.maintenanceBurnRate, err = maintenanceBurnRate(username)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return &result, nil
+}
+
+// on returns the goal for a day. Where one phase ended and another started
+// on the same day, the later one wins. Without any phases, the goal from
+// settings is all there is, so it applies throughout; otherwise days before
+// the first phase had no goal.
+func (t goalTimeline) on(day time.Time) goals {
+	if len(t.phases) == 0 {
+		return t.current
+	}
+
+	date := day.Format("2006-01-02")
+	var found *goalPhase
+	for i, g := range t.phases {
+		if g.Status == goalPlanned || g.StartDate > date || (g.EndDate != "" && g.EndDate < date) {
+			continue
+		}
+		found = &t.phases[i]
+	}
+	if found == nil {
+		return goals{IncludeExercise: t.current.IncludeExercise}
+	}
+
+	burnRate := found.BurnRate
+	if found.Kind == "maintain" && burnRate == 0 {
+		burnRate = t.maintenanceBurnRate
+	}
+	return goals{found.TargetWeight, found.TargetDate, burnRate, t.current.IncludeExercise, found.Kind, found.Band}
+}
+
+func addPlannedGoal(g goalPhase, username string) (int, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	g.Status = goalPlanned
+	id, err := insertGoalPhase(tx, g, username)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// deletePlannedGoal returns sql.ErrNoRows if there was no such planned goal,
+// since phases that have started are part of the history.
+func deletePlannedGoal(id int, username string) error {
+	res, err := database.Exec("DELETE FROM goal WHERE id = ? AND status = ? AND username = ?", id, goalPlanned, username)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err == nil && rows == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+// calcGoalOutcome decides whether a phase has finished given the trend on a
+// day: the trend reaching the target achieves a cut or bulk, so a single
+// light or heavy weigh-in doesn't, while passing the target date first misses
+// it. Maintenance runs until its date, if it has one.
+func calcGoalOutcome(g goalPhase, trend float64, day time.Time) string {
+	if g.Kind == "cut" && trend <= g.TargetWeight {
+		return goalAchieved
+	} else if g.Kind == "bulk" && trend >= g.TargetWeight {
+		return goalAchieved
+	}
+
+	if g.TargetDate == "" || day.Format("2006-01-02") <= g.TargetDate {
+		return ""
+	}
+	if g.Kind == "maintain" {
+		return goalAchieved
+	}
+	return goalMissed
+}
+
+// updateGoalProgress checks the active phase against the trend after a newly
+// recorded weight, and if it has finished, starts the next planned phase from
+// that trend. Planned phases are checked against the guardrails again as they
+// start, since the trend and the time left may have changed since they were
+// planned; any that no longer pass are skipped as replaced. If nothing was
+// planned after reaching a target, maintenance at that target starts
+// instead, so there is always a budget to eat to.
+func updateGoalProgress(trend float64, day time.Time, username string) error {
+	active, err := getActiveGoal(username)
+	if err != nil || active == nil {
+		return err
+	}
+
+	outcome := calcGoalOutcome(*active, trend, day)
+	if outcome == "" {
+		return nil
+	}
+
+	profile, err := getProfile(username)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	date := day.Format("2006-01-02")
+	_, err = tx.Exec("UPDATE goal SET status = ?, end_date = ? WHERE id = ?", outcome, date, active.ID)
+	if err != nil {
+		return err
+	}
+
+	started := false
+	for !started {
+		row := tx.QueryRow("SELECT "+goalColumns+" FROM goal WHERE status = ? AND username = ? ORDER BY sequence LIMIT 1", goalPlanned, username)
+		next, err := scanGoalPhase(row.Scan)
+		if err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		status, endDate := goalActive, ""
+		if validateGoal(next, trend, profile.Sex, day) != nil {
+			status, endDate = goalReplaced, date
+		}
+		_, err = tx.Exec("UPDATE goal SET status = ?, start_date = ?, start_weight = ?, end_date = ? WHERE id = ?",
+			status, date, trend, endDate, next.ID)
+		if err != nil {
+			return err
+		}
+		started = status == goalActive
+	}
+
+	if !started && outcome == goalAchieved && active.Kind != "maintain" {
+		maintenance := goalPhase{Kind: "maintain", Status: goalActive, StartDate: date, StartWeight: trend,
+			TargetWeight: active.TargetWeight, BurnRate: active.BurnRate, Band: defaultMaintenanceBand}
+		if _, err = insertGoalPhase(tx, maintenance, username); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// parseGoalPhase reads a goal from the request, in the same form fields that
+// the goals section has always posted.
+func parseGoalPhase(r *http.Request) (*goalPhase, []validationError) {
+	g := goalPhase{Kind: r.FormValue("kind"), TargetDate: r.FormValue("target_date")}
+
+	var ok bool
+	if g.TargetWeight, ok = formFloat(r, "target_weight"); !ok {
+		return nil, []validationError{{Field: "target_weight", Message: "target weight must be a number"}}
+	}
+	if r.FormValue("daily_burn_rate") != "" {
+		if g.BurnRate, ok = formInt(r, "daily_burn_rate"); !ok {
+			return nil, []validationError{{Field: "daily_burn_rate", Message: "burn rate must be a whole number"}}
+		}
+	}
+	if r.FormValue("band") != "" {
+		if g.Band, ok = formFloat(r, "band"); !ok {
+			return nil, []validationError{{Field: "band", Message: "band must be a number"}}
+		}
+	}
+
+	if fields := checkGoalPhase(&g); len(fields) > 0 {
+		return nil, fields
+	}
+	return &g, nil
+}
+
+// checkGoalPhase fills in the defaults for a goal and returns anything about
+// it that doesn't make sense.
+// Kind defaults to a cut. A maintenance phase doesn't need a target date,
+// takes a band either side of the target, and can leave out the burn rate
+// to use the estimate from the profile.
+func checkGoalPhase(g *goalPhase) []validationError {
+	if g.Kind == "" {
+		g.Kind = "cut"
+	}
+
+	result := []validationError{}
+	if !goalKinds[g.Kind] {
+		result = append(result, validationError{Field: "kind", Message: "kind must be cut, maintain or bulk"})
+	}
+	if g.TargetWeight <= 0 {
+		result = append(result, validationError{Field: "target_weight", Message: "a target weight is required"})
+	}
+
+	if g.TargetDate != "" || g.Kind != "maintain" {
+		if _, err := time.Parse("2006-01-02", g.TargetDate); err != nil {
+			result = append(result, validationError{Field: "target_date", Message: "target date must be in the form yyyy-mm-dd"})
+		}
+	}
+
+	if g.BurnRate < 0 || (g.BurnRate == 0 && g.Kind != "maintain") {
+		result = append(result, validationError{Field: "daily_burn_rate", Message: "a daily burn rate is required"})
+	}
+
+	if g.Kind != "maintain" {
+		g.Band = 0
+	} else if g.Band == 0 {
+		g.Band = defaultMaintenanceBand
+	}
+	if g.Band < 0 || g.Band > 10 {
+		result = append(result, validationError{Field: "band", Message: "band must be between 0 and 10 kg"})
+	}
+	return result
+}
+
+func goalHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	phases, err := getGoalPhases(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(phases)
+	case mimeText:
+		for _, g := range phases {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s %g\t%s %g\t%s\n", g.ID, g.Kind, g.Status, g.StartDate, g.StartWeight, g.TargetDate, g.TargetWeight, g.EndDate)
+		}
+	}
+}
+
+func planGoalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	g, fields := parseGoalPhase(r)
+	if len(fields) > 0 {
+		badRequest(w, r, "invalid goal", fields...)
+		return
+	}
+
+	currentUser := currentUser(r)
+	weight, err := getLatestWeight(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	profile, err := getProfile(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if v := validateGoal(*g, weight, profile.Sex, time.Now()); v != nil {
+		validationFailed(w, r, "goal is outside safe limits", v.Errors)
+		return
+	}
+
+	_, err = addPlannedGoal(*g, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func deletePlannedGoalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	err := deletePlannedGoal(id, currentUser(r))
+	if err == sql.ErrNoRows {
+		notFound(w, r)
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
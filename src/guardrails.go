@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Goals are checked before they're accepted, so that nobody is given a
+// budget that loses weight faster than is safe, or that is too low to get
+// enough nutrition from. The limits come from the config, defaulting to the
+// usual advice of at most 1% of body weight a week, and at least 1500
+// calories a day for men and 1200 for women.
+
+const defaultMaxWeeklyLossPercent = 1.0
+const defaultMinCaloriesMale = 1500
+const defaultMinCaloriesFemale = 1200
+
+type goalValidation struct {
+	Errors        []validationError
+	SuggestedDate string
+}
+
+// calorieFloor is the lowest daily budget allowed for the sex in the user's
+// profile, falling back on the women's floor when the profile isn't set.
+func calorieFloor(sex string) int {
+	if sex == "male" {
+		return config.MinCaloriesMale
+	}
+	return config.MinCaloriesFemale
+}
+
+// validateGoal checks a goal against the guardrails for someone of the given
+// weight, returning nil if it's acceptable. When a cut is too aggressive,
+// the earliest target date that would keep within the limits is suggested.
+func validateGoal(g goalPhase, currentWeight float64, sex string, now time.Time) *goalValidation {
+	result := goalValidation{Errors: []validationError{}}
+
+	floor := calorieFloor(sex)
+	if g.BurnRate != 0 && (g.BurnRate < 1000 || g.BurnRate > 6000) {
+		result.Errors = append(result.Errors, validationError{Field: "daily_burn_rate", Message: "burn rate must be between 1000 and 6000 calories"})
+	} else if g.BurnRate != 0 && g.BurnRate < floor {
+		result.Errors = append(result.Errors, validationError{Field: "daily_burn_rate", Message: fmt.Sprintf("burn rate is below the minimum daily budget of %d calories", floor)})
+	}
+	if g.TargetWeight < 30 || g.TargetWeight > 300 {
+		result.Errors = append(result.Errors, validationError{Field: "target_weight", Message: "target weight must be between 30 and 300 kg"})
+	}
+
+	if g.Kind == "maintain" || len(result.Errors) > 0 {
+		return result.orNil()
+	}
+
+	if currentWeight == 0 {
+		result.Errors = append(result.Errors, validationError{Field: "target_weight", Message: "record a weight before setting a goal"})
+		return result.orNil()
+	}
+
+	date, _ := time.Parse("2006-01-02", g.TargetDate)
+	days := date.Sub(now).Hours() / 24
+	if days < 1 {
+		result.Errors = append(result.Errors, validationError{Field: "target_date", Message: "target date must be in the future"})
+		return result.orNil()
+	}
+
+	if g.Kind != "cut" || g.TargetWeight >= currentWeight {
+		return result.orNil()
+	}
+
+	toLose := currentWeight - g.TargetWeight
+	maxWeekly := currentWeight * config.MaxWeeklyLossPercent / 100
+	minDays := math.Ceil(toLose / maxWeekly * 7)
+	if days < minDays {
+		result.Errors = append(result.Errors, validationError{Field: "target_date",
+			Message: fmt.Sprintf("losing more than %g%% of body weight a week is not recommended", config.MaxWeeklyLossPercent)})
+	}
+
+	budget := float64(g.BurnRate) - toLose*7700/days
+	if budget < float64(floor) {
+		result.Errors = append(result.Errors, validationError{Field: "target_date",
+			Message: fmt.Sprintf("this goal needs a daily budget of %d calories, below the minimum of %d", int(budget), floor)})
+		if g.BurnRate <= floor {
+			// eating at the floor loses nothing, so no date would do
+			result.Errors = append(result.Errors, validationError{Field: "daily_burn_rate",
+				Message: fmt.Sprintf("a burn rate of %d calories can't reach the target without going below the minimum of %d", g.BurnRate, floor)})
+			return result.orNil()
+		}
+		if floorDays := math.Ceil(toLose * 7700 / float64(g.BurnRate-floor)); floorDays > minDays {
+			minDays = floorDays
+		}
+	}
+
+	if len(result.Errors) > 0 {
+		result.SuggestedDate = now.AddDate(0, 0, int(minDays)).Format("2006-01-02")
+		for i := range result.Errors {
+			if result.Errors[i].Field == "target_date" {
+				result.Errors[i].Suggestion = result.SuggestedDate
+			}
+		}
+	}
+	return result.orNil()
+}
+
+func (v *goalValidation) orNil() *goalValidation {
+	if len(v.Errors) == 0 {
+		return nil
+	}
+	return v
+}
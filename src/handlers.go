@@ -1,10 +1,10 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math"
 	"net/http"
 	"strconv"
@@ -17,13 +17,12 @@ func currentUser(r *http.Request) string {
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 	html, err := ioutil.ReadFile("./index.html")
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html")
@@ -32,7 +31,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 
 func todayHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 
@@ -41,8 +40,7 @@ func todayHandler(w http.ResponseWriter, r *http.Request) {
 
 	weight, err := getDayWeight(day, currentUser)
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
@@ -50,60 +48,132 @@ func todayHandler(w http.ResponseWriter, r *http.Request) {
 	if weight == 0 {
 		lastWeight, err = getLatestWeight(currentUser)
 		if err != nil {
-			log.Println("ERROR: " + err.Error())
-			http.Error(w, "server error", 500)
+			serverError(w, r, err)
 			return
 		}
 	}
 
 	calories, err := getDayCalories(day, currentUser)
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
+	exercise, err := getDayExercise(day, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	exerciseBurn := totalExerciseBurn(exercise)
+
+	intake, err := getDayIntake(day, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	intakeTargets, err := getIntakeTargets(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	intakeTotals := calcIntakeTotals(intake, intakeTargets)
+
 	goals, err := getGoals(currentUser)
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
 	var todayMax *int
 	if weight != 0 {
-		todayMax = calcTodayMax(*goals, weight)
+		todayMax = calcTodayMax(*goals, weight, exerciseBurn)
 	} else if lastWeight != 0 {
-		todayMax = calcTodayMax(*goals, lastWeight)
+		todayMax = calcTodayMax(*goals, lastWeight, exerciseBurn)
+	}
+
+	trend, err := getLatestTrend(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
 	}
+	maintenance := calcMaintenanceStatus(*goals, trend)
 
-	contentType := r.Header.Get("Content-type")
-	if contentType == "application/json" {
-		w.Header().Set("Content-Type", contentType)
+	budgets := []categoryBudget{}
+	if todayMax != nil {
+		categories, err := getCategories(currentUser)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		budgets = calcCategoryBudgets(categories, calories, *todayMax)
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
 		result := struct {
-			Weight     float64
-			LastWeight float64
-			Calories   []calorieEntry
-			TodayMax   *int
-		}{weight, lastWeight, calories, todayMax}
+			Weight       float64
+			LastWeight   float64
+			Calories     []calorieEntry
+			TodayMax     *int
+			Budgets      []categoryBudget
+			Exercise     []exerciseEntry
+			ExerciseBurn int
+			Intake       []intakeTotal
+			Maintenance  *maintenanceStatus
+		}{weight, lastWeight, calories, todayMax, budgets, exercise, exerciseBurn, intakeTotals, maintenance}
 		json.NewEncoder(w).Encode(result)
-	} else {
+	case mimeText:
 		fmt.Fprintln(w, weight)
 		for _, entry := range calories {
 			fmt.Fprintf(w, "%d %s\n", entry.Amount, entry.Category)
 		}
+		for _, total := range intakeTotals {
+			fmt.Fprintf(w, "%g%s %s\n", total.Amount, total.Unit, total.Kind)
+		}
+		if maintenance != nil && maintenance.Correction != 0 {
+			fmt.Fprintf(w, "trend %gkg outside band, adjust by %d cal/day\n", maintenance.Drift, maintenance.Correction)
+		}
+	}
+}
+
+// calcTodayMax is calcDayMax for right now, with today's exercise added to
+// the burn rate if the user has opted to eat back what they exercise off.
+func calcTodayMax(goals goals, currentWeight float64, exerciseBurn int) *int {
+	if goals.IncludeExercise {
+		goals.BurnRate += exerciseBurn
 	}
+	return calcDayMax(goals, currentWeight, time.Now())
 }
 
-func calcTodayMax(goals goals, currentWeight float64) *int {
-	if goals.TargetDate == "" || goals.TargetWeight == 0 || goals.TargetWeight >= currentWeight || goals.BurnRate == 0 {
+// calcDayMax works out the calorie allowance for a given day, based on the
+// weight on that day and how long remained until the target date. A bulk
+// works the same way as a cut but in reverse, giving a surplus rather than a
+// deficit. Maintenance, and a cut or bulk whose target has been reached, is
+// simply the burn rate.
+func calcDayMax(goals goals, currentWeight float64, day time.Time) *int {
+	if goals.BurnRate == 0 {
+		return nil
+	}
+	if goals.Kind == "maintain" {
+		result := goals.BurnRate
+		return &result
+	}
+	if goals.TargetDate == "" || goals.TargetWeight == 0 {
 		return nil
 	}
+	if (goals.Kind == "bulk" && goals.TargetWeight <= currentWeight) || (goals.Kind != "bulk" && goals.TargetWeight >= currentWeight) {
+		result := goals.BurnRate
+		return &result
+	}
 	date, err := time.Parse("2006-01-02", goals.TargetDate)
 	if err != nil {
 		return nil
 	}
-	days := date.Sub(time.Now()).Hours() / 24
+	days := date.Sub(day).Hours() / 24
+	if days <= 0 {
+		return nil
+	}
 	amount := (currentWeight - goals.TargetWeight) * 7700 // 7700 is cals per kg, roughly
 	result := int(float64(goals.BurnRate) - (amount / days))
 	if result < 0 {
@@ -114,28 +184,29 @@ func calcTodayMax(goals goals, currentWeight float64) *int {
 
 func weightHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 
 	formValue := r.FormValue("weight")
 	if formValue == "" {
-		http.Error(w, "bad request", 400)
+		invalidField(w, r, "weight", "a weight is required")
 		return
 	}
 
 	val, err := strconv.ParseFloat(formValue, 32)
 	if err != nil {
-		http.Error(w, "bad request", 400)
+		invalidField(w, r, "weight", "weight must be a number")
 		return
 	}
 
 	rounded := math.Round(val*100) / 100
 
-	err = addWeightEntry(time.Now(), rounded, currentUser(r))
+	day := time.Now()
+	currentUser := currentUser(r)
+	_, err = recordWeight(day, rounded, currentUser)
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
@@ -144,28 +215,27 @@ func weightHandler(w http.ResponseWriter, r *http.Request) {
 
 func caloriesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 
 	formValue := r.FormValue("amount")
 	if formValue == "" {
-		http.Error(w, "bad request", 400)
+		invalidField(w, r, "amount", "an amount is required")
 		return
 	}
 
 	calories, err := strconv.Atoi(formValue)
 	if err != nil {
-		http.Error(w, "bad request", 400)
+		invalidField(w, r, "amount", "amount must be a whole number")
 		return
 	}
 
 	category := r.FormValue("category")
 
-	err = addCalorieEntry(time.Now(), int(calories), category, currentUser(r))
+	_, err = addCalorieEntry(time.Now(), int(calories), category, currentUser(r))
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
@@ -174,167 +244,190 @@ func caloriesHandler(w http.ResponseWriter, r *http.Request) {
 
 func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 
 	formValue := r.FormValue("id")
 	if formValue == "" {
-		http.Error(w, "bad request", 400)
+		invalidField(w, r, "id", "id must be a whole number")
 		return
 	}
 
 	id, err := strconv.Atoi(formValue)
 	if err != nil {
-		http.Error(w, "bad request", 400)
+		invalidField(w, r, "id", "id must be a whole number")
 		return
 	}
 
 	err = deleteCalorieEntry(id, currentUser(r))
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
-func categoriesHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.NotFound(w, r)
-		return
-	}
-
-	categories, err := getCalorieCategories(currentUser(r))
-	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
-		return
-	}
-
-	contentType := r.Header.Get("Content-type")
-	if contentType == "application/json" {
-		w.Header().Set("Content-Type", contentType)
-		json.NewEncoder(w).Encode(categories)
-	} else {
-		for _, category := range categories {
-			fmt.Fprintln(w, category)
-		}
-	}
-}
-
 func goalsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		setGoalsHandler(w, r)
 	} else if r.Method == "GET" {
 		getGoalsHandler(w, r)
 	} else {
-		http.NotFound(w, r)
+		notFound(w, r)
 	}
 }
 
 func setGoalsHandler(w http.ResponseWriter, r *http.Request) {
-	weight := r.FormValue("target_weight")
-	if weight == "" {
-		http.Error(w, "bad request", 400)
+	goal, fields := parseGoalPhase(r)
+	if len(fields) > 0 {
+		badRequest(w, r, "invalid goal", fields...)
 		return
 	}
 
-	_, err := strconv.ParseFloat(weight, 32)
-	if err != nil {
-		http.Error(w, "bad request", 400)
-		return
+	includeExercise := r.FormValue("include_exercise")
+	if includeExercise != "" {
+		_, err := strconv.ParseBool(includeExercise)
+		if err != nil {
+			invalidField(w, r, "include_exercise", "include exercise must be true or false")
+			return
+		}
 	}
 
-	date := r.FormValue("target_date")
-	if date == "" {
-		http.Error(w, "bad request", 400)
+	currentUser := currentUser(r)
+	startWeight, err := getLatestWeight(currentUser)
+	if err != nil {
+		serverError(w, r, err)
 		return
 	}
 
-	_, err = time.Parse("2006-01-02", date)
+	profile, err := getProfile(currentUser)
 	if err != nil {
-		http.Error(w, "bad request", 400)
+		serverError(w, r, err)
 		return
 	}
 
-	burnRate := r.FormValue("daily_burn_rate")
-	if burnRate == "" {
-		http.Error(w, "bad request", 400)
+	if v := validateGoal(*goal, startWeight, profile.Sex, time.Now()); v != nil {
+		validationFailed(w, r, "goal is outside safe limits", v.Errors)
 		return
 	}
 
-	_, err = strconv.Atoi(burnRate)
+	err = setActiveGoal(*goal, time.Now(), startWeight, currentUser)
+	if err == nil && includeExercise != "" {
+		err = setSetting("include_exercise", includeExercise, currentUser)
+	}
 	if err != nil {
-		http.Error(w, "bad request", 400)
+		serverError(w, r, err)
 		return
 	}
 
-	currentUser := currentUser(r)
-	err = setSetting("target_weight", weight, currentUser)
-	if err == nil {
-		err = setSetting("target_date", date, currentUser)
-		if err == nil {
-			err = setSetting("daily_burn_rate", burnRate, currentUser)
-		}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type goalsSummary struct {
+	goals
+	HealthyWeightMin float64
+	HealthyWeightMax float64
+}
+
+// getGoalsSummary returns the current goal along with the healthy weight
+// range for the user's height, when it's known.
+func getGoalsSummary(username string) (*goalsSummary, error) {
+	goals, err := getGoals(username)
+	if err != nil {
+		return nil, err
 	}
+
+	profile, err := getProfile(username)
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
-		return
+		return nil, err
 	}
 
-	w.WriteHeader(http.StatusAccepted)
+	result := goalsSummary{goals: *goals}
+	if profile.Height > 0 {
+		result.HealthyWeightMin, result.HealthyWeightMax = calcHealthyWeightRange(profile.Height)
+	}
+	return &result, nil
 }
 
 func getGoalsHandler(w http.ResponseWriter, r *http.Request) {
-	goals, err := getGoals(currentUser(r))
+	summary, err := getGoalsSummary(currentUser(r))
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
-	contentType := r.Header.Get("Content-type")
-	if contentType == "application/json" {
-		w.Header().Set("Content-Type", contentType)
-		json.NewEncoder(w).Encode(goals)
-	} else {
-		fmt.Fprintln(w, goals.TargetWeight)
-		fmt.Fprintln(w, goals.TargetDate)
-		fmt.Fprintln(w, goals.BurnRate)
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(summary)
+	case mimeText:
+		fmt.Fprintln(w, summary.TargetWeight)
+		fmt.Fprintln(w, summary.TargetDate)
+		fmt.Fprintln(w, summary.BurnRate)
+		fmt.Fprintln(w, summary.IncludeExercise)
+		fmt.Fprintln(w, summary.Kind)
+		fmt.Fprintln(w, summary.HealthyWeightMin)
+		fmt.Fprintln(w, summary.HealthyWeightMax)
 	}
 }
 
 func historyHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 
 	result, err := allDaysForUser(currentUser(r))
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
+	format := ""
 	asFile := r.FormValue("asfile")
-
-	contentType := r.Header.Get("Content-type")
-	if contentType == "application/json" || asFile == "json" {
-		if asFile != "" {
-			w.Header().Set("Content-disposition", ": attachment; filename=alldata.json")
+	if asFile != "" {
+		download, exists := downloadFormats[asFile]
+		if !exists {
+			invalidField(w, r, "asfile", "unknown file format")
+			return
 		}
-		w.Header().Set("Content-Type", contentType)
-		json.NewEncoder(w).Encode(result)
+		format = download.mime
+		w.Header().Set("Content-Type", responseTypes[format])
+		w.Header().Set("Content-disposition", "attachment; filename=alldata."+download.extension)
 	} else {
-		if asFile != "" {
-			w.Header().Set("Content-disposition", ": attachment; filename=alldata.txt")
+		format = negotiateResponse(w, r, mimeText, mimeJSON, mimeCSV)
+	}
+
+	switch format {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(result)
+	case mimeCSV:
+		// each kind of intake gets its own column, as categories do in reports
+		kinds := intakeKinds(result)
+		writer := csv.NewWriter(w)
+		writer.Write(append([]string{"date", "weight", "calories", "rung"}, kinds...))
+		for _, day := range result {
+			total := 0
+			for _, entry := range day.Entries {
+				total += entry.Amount
+			}
+			row := []string{day.Date[:10], strconv.FormatFloat(day.Weight, 'f', -1, 64), strconv.Itoa(total), strconv.Itoa(day.Rung)}
+			for _, kind := range kinds {
+				row = append(row, strconv.FormatFloat(day.Intake[kind], 'f', -1, 64))
+			}
+			writer.Write(row)
 		}
+		writer.Flush()
+	case mimeText:
 		for _, day := range result {
 			fmt.Fprintf(w, "%s %f\n", day.Date, day.Weight)
+			if day.Rung != 0 {
+				fmt.Fprintf(w, "rung %d\n", day.Rung)
+			}
+			for _, kind := range intakeKinds([]recordedDay{day}) {
+				fmt.Fprintf(w, "%g%s\t%s\n", day.Intake[kind], intakeUnits[kind], kind)
+			}
 			for _, entry := range day.Entries {
 				fmt.Fprintf(w, "%d\t%s\n", entry.Amount, entry.Category)
 			}
@@ -346,58 +439,93 @@ type trendEntry struct {
 	Date     string
 	Recorded float64
 	Weighted float64
+	Rung     int
 }
 
 func trendHandler(w http.ResponseWriter, r *http.Request) {
 
 	allEntries, err := allDaysForUser(currentUser(r))
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
+	result := calcWeightTrend(allEntries)
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON, mimeCSV) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(result)
+	case mimeCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"date", "recorded", "weighted", "rung"})
+		for _, entry := range result {
+			writer.Write([]string{entry.Date, strconv.FormatFloat(entry.Recorded, 'f', -1, 64), strconv.FormatFloat(entry.Weighted, 'f', -1, 64), strconv.Itoa(entry.Rung)})
+		}
+		writer.Flush()
+	case mimeText:
+		for _, entry := range result {
+			fmt.Fprintf(w, "%s\n%f\n%f\n%d\n\n", entry.Date, entry.Recorded, entry.Weighted, entry.Rung)
+		}
+	}
+}
+
+func calcWeightTrend(days []recordedDay) []trendEntry {
+	weights := make([]float64, len(days))
+	for i, day := range days {
+		weights[i] = day.Weight
+	}
+	weighted := calcTrend(weights)
+
 	result := make([]trendEntry, 0)
+	for i, day := range days {
+		result = append(result, trendEntry{day.Date[:10], day.Weight, weighted[i], day.Rung})
+	}
+	return result
+}
+
+// calcTrend smooths a series of daily values with a two week moving average,
+// so the day to day noise of water weight and the like is evened out.
+func calcTrend(values []float64) []float64 {
+	result := make([]float64, 0, len(values))
 	var lastTwoWeeks []float64
 
-	for _, day := range allEntries {
-		entry := trendEntry{day.Date[:10], day.Weight, 0.0}
+	for _, value := range values {
 		if len(lastTwoWeeks) == 14 {
-			lastTwoWeeks = append(lastTwoWeeks[1:], day.Weight)
+			lastTwoWeeks = append(lastTwoWeeks[1:], value)
 		} else {
-			lastTwoWeeks = append(lastTwoWeeks, day.Weight)
+			lastTwoWeeks = append(lastTwoWeeks, value)
 		}
 		sum := 0.0
-		for _, weight := range lastTwoWeeks {
-			sum += weight
+		for _, v := range lastTwoWeeks {
+			sum += v
 		}
-		entry.Weighted = math.Round((sum/float64(len(lastTwoWeeks)))*100) / 100
-		result = append(result, entry)
+		result = append(result, math.Round((sum/float64(len(lastTwoWeeks)))*100)/100)
 	}
 
-	contentType := r.Header.Get("Content-type")
-	if contentType == "application/json" {
-		w.Header().Set("Content-Type", contentType)
-		json.NewEncoder(w).Encode(result)
-	} else {
-		for _, entry := range result {
-			fmt.Fprintf(w, "%s\n%f\n%f\n\n", entry.Date, entry.Recorded, entry.Weighted)
-		}
-	}
+	return result
 }
 
 func clearAllEntriesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 
 	err := clearAllEntries(currentUser(r))
 	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		http.Error(w, "server error", 500)
+		serverError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusAccepted)
 }
+
+func formInt(r *http.Request, key string) (int, bool) {
+	val, err := strconv.Atoi(r.FormValue(key))
+	return val, err == nil
+}
+
+func formFloat(r *http.Request, key string) (float64, bool) {
+	val, err := strconv.ParseFloat(r.FormValue(key), 64)
+	return val, err == nil && !math.IsNaN(val) && !math.IsInf(val, 0)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// intake covers things worth tracking that don't count towards calories,
+// like water. Any kind can be logged; these are just the ones with known units.
+var intakeUnits = map[string]string{
+	"water":    "ml",
+	"caffeine": "mg",
+	"sodium":   "mg",
+	"fibre":    "g",
+}
+
+const intakeTargetPrefix = "intake_target_"
+
+var intakeKindPattern = regexp.MustCompile(`^[a-z][a-z_]{0,31}$`)
+
+type intakeEntry struct {
+	ID     int
+	Kind   string
+	Amount float64
+}
+
+type intakeTotal struct {
+	Kind   string
+	Unit   string
+	Amount float64
+	Target float64
+}
+
+func addIntakeEntry(day time.Time, kind string, amount float64, username string) error {
+	date := day.Format(time.RFC3339)
+	_, err := database.Exec("INSERT INTO intake_entry (date, kind, amount, username) VALUES (?, ?, ?, ?)", date, kind, amount, username)
+	return err
+}
+
+func deleteIntakeEntry(id int, username string) error {
+	_, err := database.Exec("DELETE FROM intake_entry WHERE id = ? AND username = ?", id, username)
+	return err
+}
+
+func getDayIntake(day time.Time, username string) ([]intakeEntry, error) {
+	start, end := getDayStartAndEnd(day)
+
+	rows, err := database.Query("SELECT id, kind, amount FROM intake_entry WHERE date >= ? AND date <= ? AND username = ?", start, end, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]intakeEntry, 0)
+	for rows.Next() {
+		var row intakeEntry
+		err = rows.Scan(&row.ID, &row.Kind, &row.Amount)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+
+	return result, nil
+}
+
+func getIntakeTargets(username string) (map[string]float64, error) {
+	settings, err := getSettings(username)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]float64)
+	for key, val := range settings {
+		if !strings.HasPrefix(key, intakeTargetPrefix) {
+			continue
+		}
+		target, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, err
+		}
+		if target > 0 {
+			result[strings.TrimPrefix(key, intakeTargetPrefix)] = target
+		}
+	}
+
+	return result, nil
+}
+
+// calcIntakeTotals sums a day's intake by kind, including kinds that have a
+// target but nothing logged yet.
+func calcIntakeTotals(entries []intakeEntry, targets map[string]float64) []intakeTotal {
+	amounts := make(map[string]float64)
+	for kind := range targets {
+		amounts[kind] = 0
+	}
+	for _, entry := range entries {
+		amounts[entry.Kind] += entry.Amount
+	}
+
+	kinds := make([]string, 0, len(amounts))
+	for kind := range amounts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	result := make([]intakeTotal, 0, len(kinds))
+	for _, kind := range kinds {
+		result = append(result, intakeTotal{kind, intakeUnits[kind], math.Round(amounts[kind]*10) / 10, targets[kind]})
+	}
+	return result
+}
+
+// intakeKinds lists every kind of intake logged on any of the days, in order.
+func intakeKinds(days []recordedDay) []string {
+	kindSet := map[string]bool{}
+	for _, day := range days {
+		for kind := range day.Intake {
+			kindSet[kind] = true
+		}
+	}
+	result := make([]string, 0, len(kindSet))
+	for kind := range kindSet {
+		result = append(result, kind)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func appendIntakeToDays(username string, days map[string]recordedDay) (map[string]recordedDay, error) {
+	rows, err := database.Query("SELECT kind, amount, date FROM intake_entry WHERE username = ? ORDER BY date", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, date string
+		var amount float64
+		err = rows.Scan(&kind, &amount, &date)
+		if err != nil {
+			return nil, err
+		}
+
+		dateVal, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			return nil, err
+		}
+
+		start, _ := getDayStartAndEnd(dateVal)
+		day, exists := days[start]
+		if !exists {
+			continue
+		}
+		if day.Intake == nil {
+			day.Intake = make(map[string]float64)
+		}
+		day.Intake[kind] += amount
+		days[start] = day
+	}
+
+	return days, nil
+}
+
+func addIntakeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	kind := r.FormValue("kind")
+	if !intakeKindPattern.MatchString(kind) {
+		invalidField(w, r, "kind", "unknown intake kind")
+		return
+	}
+
+	amount, ok := formFloat(r, "amount")
+	if !ok || amount <= 0 {
+		invalidField(w, r, "amount", "amount must be a number greater than 0")
+		return
+	}
+
+	err := addIntakeEntry(time.Now(), kind, amount, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func deleteIntakeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	err := deleteIntakeEntry(id, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func intakeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	day := time.Now()
+	if date := r.FormValue("date"); date != "" {
+		var err error
+		day, err = time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			invalidField(w, r, "date", "date must be in the form yyyy-mm-dd")
+			return
+		}
+	}
+
+	entries, err := getDayIntake(day, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(entries)
+	case mimeText:
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%d\t%s\t%g%s\n", entry.ID, entry.Kind, entry.Amount, intakeUnits[entry.Kind])
+		}
+	}
+}
+
+// intakeTargetHandler sets the daily target for a kind of intake; a target of
+// zero removes it.
+func intakeTargetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	kind := r.FormValue("kind")
+	if !intakeKindPattern.MatchString(kind) {
+		invalidField(w, r, "kind", "unknown intake kind")
+		return
+	}
+
+	target, ok := formFloat(r, "target")
+	if !ok || target < 0 {
+		invalidField(w, r, "target", "target must be a number of at least 0")
+		return
+	}
+
+	err := setSetting(intakeTargetPrefix+kind, strconv.FormatFloat(target, 'f', -1, 64), currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
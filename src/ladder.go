@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The Hacker Diet pairs weight control with an exercise ladder: a fixed
+// routine of six exercises whose repetitions slowly increase rung by rung.
+// Each rung takes the same time to complete, so progress comes from doing
+// more in it rather than exercising for longer. The ladder here is modelled
+// on that one, with 48 rungs in six levels, but its repetitions are its own
+// rather than the book's.
+
+const ladderRungs = 48
+
+// number of consecutive completed days on a rung before moving up, and of
+// consecutive failed days before dropping back one.
+const daysToAdvance = 3
+const failuresToDrop = 2
+
+type ladderRung struct {
+	Rung          int
+	Level         int
+	Bends         int
+	SitUps        int
+	LegRaises     int
+	SideLegRaises int
+	PushUps       int
+	Steps         int
+}
+
+type rungEntry struct {
+	Date      string
+	Rung      int
+	Completed bool
+}
+
+type ladderStatus struct {
+	CurrentRung   int
+	DaysOnRung    int
+	Suggestion    string
+	SuggestedRung int
+	Recent        []rungEntry
+}
+
+// ladder lists every rung in order, one row per rung: rung, level, bends,
+// sit-ups, leg raises, side leg raises, push-ups and running steps. Each
+// count climbs evenly from the first rung to the last, so it won't match the
+// book's table rung for rung.
+var ladder = []ladderRung{
+	{1, 1, 2, 3, 4, 2, 2, 75},
+	{2, 1, 3, 4, 5, 3, 3, 85},
+	{3, 1, 3, 4, 6, 3, 4, 94},
+	{4, 1, 4, 5, 6, 4, 4, 104},
+	{5, 1, 4, 5, 7, 4, 5, 113},
+	{6, 1, 5, 6, 8, 5, 6, 123},
+	{7, 1, 6, 7, 9, 6, 7, 132},
+	{8, 1, 6, 7, 9, 6, 8, 142},
+
+	{9, 2, 7, 8, 10, 7, 8, 152},
+	{10, 2, 7, 9, 11, 7, 9, 161},
+	{11, 2, 8, 9, 12, 8, 10, 171},
+	{12, 2, 9, 10, 12, 9, 11, 180},
+	{13, 2, 9, 10, 13, 9, 12, 190},
+	{14, 2, 10, 11, 14, 10, 13, 199},
+	{15, 2, 10, 12, 15, 10, 13, 209},
+	{16, 2, 11, 12, 15, 11, 14, 219},
+
+	{17, 3, 12, 13, 16, 12, 15, 228},
+	{18, 3, 12, 13, 17, 12, 16, 238},
+	{19, 3, 13, 14, 18, 13, 17, 247},
+	{20, 3, 13, 15, 19, 13, 17, 257},
+	{21, 3, 14, 15, 19, 14, 18, 266},
+	{22, 3, 15, 16, 20, 15, 19, 276},
+	{23, 3, 15, 17, 21, 15, 20, 286},
+	{24, 3, 16, 17, 22, 16, 21, 295},
+
+	{25, 4, 16, 18, 22, 16, 21, 305},
+	{26, 4, 17, 18, 23, 17, 22, 314},
+	{27, 4, 17, 19, 24, 17, 23, 324},
+	{28, 4, 18, 20, 25, 18, 24, 334},
+	{29, 4, 19, 20, 25, 19, 25, 343},
+	{30, 4, 19, 21, 26, 19, 25, 353},
+	{31, 4, 20, 22, 27, 20, 26, 362},
+	{32, 4, 20, 22, 28, 20, 27, 372},
+
+	{33, 5, 21, 23, 29, 21, 28, 381},
+	{34, 5, 22, 23, 29, 22, 29, 391},
+	{35, 5, 22, 24, 30, 22, 29, 401},
+	{36, 5, 23, 25, 31, 23, 30, 410},
+	{37, 5, 23, 25, 32, 23, 31, 420},
+	{38, 5, 24, 26, 32, 24, 32, 429},
+	{39, 5, 25, 26, 33, 25, 33, 439},
+	{40, 5, 25, 27, 34, 25, 34, 448},
+
+	{41, 6, 26, 28, 35, 26, 34, 458},
+	{42, 6, 26, 28, 35, 26, 35, 468},
+	{43, 6, 27, 29, 36, 27, 36, 477},
+	{44, 6, 28, 30, 37, 28, 37, 487},
+	{45, 6, 28, 30, 38, 28, 38, 496},
+	{46, 6, 29, 31, 38, 29, 38, 506},
+	{47, 6, 29, 31, 39, 29, 39, 515},
+	{48, 6, 30, 32, 40, 30, 40, 525},
+}
+
+func setRungEntry(day time.Time, rung int, completed bool, username string) error {
+	start, end := getDayStartAndEnd(day)
+	date := day.Format(time.RFC3339)
+
+	// only one rung per day, so re-recording replaces the earlier attempt
+	res, err := database.Exec("UPDATE rung_entry SET date = ?, rung = ?, completed = ? WHERE date >= ? AND date <= ? AND username = ?",
+		date, rung, completed, start, end, username)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil || rows != 0 {
+		return err
+	}
+	_, err = database.Exec("INSERT INTO rung_entry (date, rung, completed, username) VALUES (?, ?, ?, ?)", date, rung, completed, username)
+	return err
+}
+
+func getRungEntries(username string, limit int) ([]rungEntry, error) {
+	var rows *sql.Rows
+	var err error
+	if limit > 0 {
+		rows, err = database.Query("SELECT date, rung, completed FROM rung_entry WHERE username = ? ORDER BY date DESC LIMIT ?", username, limit)
+	} else {
+		rows, err = database.Query("SELECT date, rung, completed FROM rung_entry WHERE username = ? ORDER BY date DESC", username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]rungEntry, 0)
+	for rows.Next() {
+		var entry rungEntry
+		err = rows.Scan(&entry.Date, &entry.Rung, &entry.Completed)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// rungStreak returns the leading entries (newest first) recorded on the same
+// rung on consecutive calendar days, one per day. A missed day ends the
+// streak, as does a change of rung.
+func rungStreak(recent []rungEntry) []rungEntry {
+	streak := make([]rungEntry, 0, len(recent))
+	var previous time.Time
+	for _, entry := range recent {
+		dateVal, err := time.Parse(time.RFC3339, entry.Date)
+		if err != nil || entry.Rung != recent[0].Rung {
+			break
+		}
+		y, m, d := dateVal.Date()
+		day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		if len(streak) > 0 {
+			if day.Equal(previous) {
+				continue
+			}
+			if !day.Equal(previous.AddDate(0, 0, -1)) {
+				break
+			}
+		}
+		streak = append(streak, entry)
+		previous = day
+	}
+	return streak
+}
+
+// calcLadderStatus applies the ladder's rules to the most recent entries
+// (newest first): advance a rung once the current one has been completed
+// comfortably for a few days running, drop back if it keeps defeating you,
+// and otherwise hold.
+func calcLadderStatus(recent []rungEntry) ladderStatus {
+	if len(recent) == 0 {
+		return ladderStatus{0, 0, "start", 1, recent}
+	}
+
+	current := recent[0].Rung
+	streak := rungStreak(recent)
+	completed, failed := 0, 0
+	for _, entry := range streak {
+		if entry.Completed && failed == 0 {
+			completed++
+		} else if !entry.Completed && completed == 0 {
+			failed++
+		} else {
+			break
+		}
+	}
+
+	daysOnRung := len(streak)
+
+	status := ladderStatus{current, daysOnRung, "hold", current, recent}
+	if completed >= daysToAdvance && current < ladderRungs {
+		status.Suggestion = "advance"
+		status.SuggestedRung = current + 1
+	} else if failed >= failuresToDrop && current > 1 {
+		status.Suggestion = "drop"
+		status.SuggestedRung = current - 1
+	}
+	return status
+}
+
+// appendRungsToDays adds the rung recorded on each day to the history, for
+// charting alongside the weight.
+func appendRungsToDays(username string, days map[string]recordedDay) (map[string]recordedDay, error) {
+	entries, err := getRungEntries(username, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		dateVal, err := time.Parse(time.RFC3339, entry.Date)
+		if err != nil {
+			return nil, err
+		}
+
+		start, _ := getDayStartAndEnd(dateVal)
+		day, exists := days[start]
+		if !exists {
+			continue
+		}
+		day.Rung = entry.Rung
+		days[start] = day
+	}
+
+	return days, nil
+}
+
+func ladderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(ladder)
+	case mimeText:
+		for _, rung := range ladder {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", rung.Rung, rung.Level, rung.Bends, rung.SitUps, rung.LegRaises, rung.SideLegRaises, rung.PushUps, rung.Steps)
+		}
+	}
+}
+
+func ladderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	recent, err := getRungEntries(currentUser(r), 14)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	status := calcLadderStatus(recent)
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(status)
+	case mimeText:
+		fmt.Fprintln(w, status.CurrentRung)
+		fmt.Fprintln(w, status.Suggestion)
+		fmt.Fprintln(w, status.SuggestedRung)
+	}
+}
+
+func rungHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	rung, ok := formInt(r, "rung")
+	if !ok || rung < 1 || rung > ladderRungs {
+		invalidField(w, r, "rung", fmt.Sprintf("rung must be between 1 and %d", ladderRungs))
+		return
+	}
+
+	completed := true
+	if r.FormValue("completed") != "" {
+		var err error
+		completed, err = strconv.ParseBool(r.FormValue("completed"))
+		if err != nil {
+			invalidField(w, r, "completed", "completed must be true or false")
+			return
+		}
+	}
+
+	err := setRungEntry(time.Now(), rung, completed, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every login attempt costs a full Argon2id hash, so failures are counted
+// against both the address they come from and the username they were for.
+// After a few free attempts each further failure doubles how long must pass
+// before the next one, up to a limit, and attempts made before then are
+// turned away without any hashing. Addresses are only tracked in memory, but
+// usernames are kept in the database so a restart doesn't clear them.
+//
+// A username with no recent failures is checked straight away, and only a
+// wrong password is counted. Once it has failures, each attempt is counted
+// before the password is checked and taken back if it was right, so that a
+// burst of guesses at once can't all be let through before any of them has
+// been recorded. A right password forgets the username's failed logins.
+//
+// Checks made after logging in, of a two-factor code or of the current
+// password when changing it, are counted separately. Browsers send the
+// password with every request, so if they shared a count, the next request
+// would wipe out the failed guesses. Those are forgotten only once such a
+// check passes. An address that is waiting may still log in with the right
+// password, since others behind the same address shouldn't be locked out by
+// someone else's guessing.
+
+const loginFreeAttempts = 5
+const addressFreeAttempts = 20 // more, as several people may share an address
+const loginBackoffBase = time.Second
+const loginMaxBackoff = 15 * time.Minute
+const loginAttemptWindow = 24 * time.Hour // failures older than this are forgotten
+const maxTrackedAddresses = 10000
+
+// kinds of attempt, each counted separately for a username
+const (
+	attemptLogin   = "login"
+	attemptConfirm = "confirm"
+)
+
+type loginFailures struct {
+	Count int
+	Last  time.Time
+}
+
+// loginLock is held while a username's attempts are counted, so that checking
+// whether an attempt may go ahead and counting it happen together.
+// addressLock guards the failures counted against addresses.
+var loginLock sync.Mutex
+var addressLock sync.Mutex
+var addressFailures = make(map[string]loginFailures)
+
+// trustedProxies are the networks from the TrustedProxies config, whose
+// X-Forwarded-For headers are believed about where a request came from.
+var trustedProxies []*net.IPNet
+
+// retryAt returns when another attempt is allowed, once the given number of
+// free attempts have been used.
+func (f loginFailures) retryAt(free int) time.Time {
+	if f.Count < free {
+		return time.Time{}
+	}
+
+	delay := loginMaxBackoff
+	if shift := uint(f.Count - free); shift < 20 {
+		if d := loginBackoffBase << shift; d < loginMaxBackoff {
+			delay = d
+		}
+	}
+	return f.Last.Add(delay)
+}
+
+func (f loginFailures) current(now time.Time) loginFailures {
+	if now.Sub(f.Last) > loginAttemptWindow {
+		return loginFailures{}
+	}
+	return f
+}
+
+// without takes back an attempt counted at the given time. If no others have
+// been counted since, the failures from before it are put back as they were,
+// so that the wait after them isn't pushed back; otherwise only the count
+// goes down.
+func (f loginFailures) without(previous loginFailures, at time.Time) loginFailures {
+	if f.Count == previous.Count+1 && f.Last.Equal(at) {
+		return previous
+	}
+	if f.Count > 0 {
+		f.Count--
+	}
+	return f
+}
+
+// parseTrustedProxies reads the TrustedProxies config, which lists addresses
+// or networks in CIDR form.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxy = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress is the address a request came from. Behind a trusted proxy
+// that's taken from X-Forwarded-For, reading back from the end past any
+// other trusted proxies, as anything before them could have been made up by
+// the client.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(address) == nil {
+			break
+		}
+		host = address
+		if !isTrustedProxy(address) {
+			break
+		}
+	}
+	return host
+}
+
+func getLoginFailures(username, kind string) (loginFailures, error) {
+	var f loginFailures
+	var last string
+
+	row := database.QueryRow("SELECT failures, last_failure FROM login_attempt WHERE username = ? AND kind = ?", username, kind)
+	err := row.Scan(&f.Count, &last)
+	if err == sql.ErrNoRows {
+		return f, nil
+	} else if err != nil {
+		return f, err
+	}
+
+	f.Last, err = time.Parse(time.RFC3339, last)
+	return f, err
+}
+
+// setLoginFailures records failures only for users that exist, so that
+// guessing at usernames can't fill the table.
+func setLoginFailures(username, kind string, f loginFailures) error {
+	if f.Count == 0 {
+		return clearLoginFailures(username, kind)
+	}
+	_, err := database.Exec(`
+		INSERT INTO login_attempt (username, kind, failures, last_failure)
+		SELECT username, ?, ?, ? FROM users WHERE username = ?
+		ON CONFLICT (username, kind) DO UPDATE SET failures = excluded.failures, last_failure = excluded.last_failure`,
+		kind, f.Count, f.Last.Format(time.RFC3339), username)
+	return err
+}
+
+func clearLoginFailures(username, kind string) error {
+	_, err := database.Exec("DELETE FROM login_attempt WHERE username = ? AND kind = ?", username, kind)
+	return err
+}
+
+// unlockUser clears a user's failed attempts of every kind, for the
+// --unlock-user command.
+func unlockUser(username string) error {
+	var exists bool
+	err := database.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("user %s not found", username)
+	}
+	_, err = database.Exec("DELETE FROM login_attempt WHERE username = ?", username)
+	return err
+}
+
+// loginAttempt is an attempt that has been counted as a failure, either
+// ahead of checking it or because it was wrong.
+type loginAttempt struct {
+	username        string
+	kind            string
+	address         string
+	at              time.Time
+	previous        loginFailures // the username's failures before this attempt
+	userFailures    loginFailures // including this attempt
+	previousAddress loginFailures
+	addressCount    int
+	addressWait     time.Duration // how long the address would have had to wait
+}
+
+// reserveLoginAttempt counts an attempt for the request's address and the
+// username, unless the username has to wait before trying again, in which
+// case the wait is returned and nothing is counted.
+func reserveLoginAttempt(r *http.Request, username, kind string, now time.Time) (*loginAttempt, time.Duration, error) {
+	loginLock.Lock()
+	defer loginLock.Unlock()
+
+	userFailures, err := getLoginFailures(username, kind)
+	if err != nil {
+		return nil, 0, err
+	}
+	if retry := userFailures.current(now).retryAt(loginFreeAttempts); retry.After(now) {
+		return nil, retry.Sub(now), nil
+	}
+	return countLoginAttempt(r, username, kind, userFailures, now)
+}
+
+// recordLoginFailure counts an attempt that was checked without being
+// reserved, and turned out to be wrong.
+func recordLoginFailure(r *http.Request, username, kind string, now time.Time) (*loginAttempt, error) {
+	loginLock.Lock()
+	defer loginLock.Unlock()
+
+	userFailures, err := getLoginFailures(username, kind)
+	if err != nil {
+		return nil, err
+	}
+	attempt, _, err := countLoginAttempt(r, username, kind, userFailures, now)
+	return attempt, err
+}
+
+// countLoginAttempt adds an attempt to the username's failures and the
+// address's, and must be called with loginLock held.
+func countLoginAttempt(r *http.Request, username, kind string, userFailures loginFailures, now time.Time) (*loginAttempt, time.Duration, error) {
+	now = now.Truncate(time.Second) // as stored
+	previous := userFailures.current(now)
+	attempt := &loginAttempt{username: username, kind: kind, address: clientAddress(r), at: now,
+		previous: userFailures, userFailures: loginFailures{previous.Count + 1, now}}
+	if err := setLoginFailures(username, kind, attempt.userFailures); err != nil {
+		return nil, 0, err
+	}
+
+	addressLock.Lock()
+	defer addressLock.Unlock()
+
+	if len(addressFailures) >= maxTrackedAddresses {
+		for a, f := range addressFailures {
+			if f.current(now).Count == 0 {
+				delete(addressFailures, a)
+			}
+		}
+	}
+	attempt.previousAddress = addressFailures[attempt.address]
+	addressFailure := attempt.previousAddress.current(now)
+	if retry := addressFailure.retryAt(addressFreeAttempts); retry.After(now) {
+		attempt.addressWait = retry.Sub(now)
+	}
+	addressFailures[attempt.address] = loginFailures{addressFailure.Count + 1, now}
+	attempt.addressCount = addressFailure.Count + 1
+
+	return attempt, 0, nil
+}
+
+// releaseAddress takes back the attempt counted against the address.
+func releaseAddress(attempt *loginAttempt) {
+	addressLock.Lock()
+	defer addressLock.Unlock()
+
+	f, exists := addressFailures[attempt.address]
+	if !exists {
+		return
+	}
+	if f = f.without(attempt.previousAddress, attempt.at); f.Count == 0 {
+		delete(addressFailures, attempt.address)
+	} else {
+		addressFailures[attempt.address] = f
+	}
+}
+
+// refundLoginAttempt takes back an attempt that turned out not to be a
+// failure.
+func refundLoginAttempt(attempt *loginAttempt) error {
+	releaseAddress(attempt)
+
+	loginLock.Lock()
+	defer loginLock.Unlock()
+
+	f, err := getLoginFailures(attempt.username, attempt.kind)
+	if err != nil {
+		return err
+	}
+	return setLoginFailures(attempt.username, attempt.kind, f.without(attempt.previous, attempt.at))
+}
+
+// loginSucceeded takes back an attempt that proved right, and forgets the
+// username's earlier failures of the same kind.
+func loginSucceeded(attempt *loginAttempt) error {
+	releaseAddress(attempt)
+	return clearLoginFailures(attempt.username, attempt.kind)
+}
+
+func logLoginFailure(r *http.Request, attempt *loginAttempt) {
+	log.Printf("LOGIN FAILED [%s]: user %q from %s, %s failures for user %d, for address %d",
+		requestID(r), attempt.username, attempt.address, attempt.kind, attempt.userFailures.Count, attempt.addressCount)
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, errorResponse{Code: codeTooManyRequests, Message: "too many failed logins, try again later"})
+}
+
+// checkLogin tests a request's credentials, unless the username has to wait
+// before trying again, in which case the wait is returned and the password
+// isn't looked at. A wrong password from an address that has to wait also
+// returns the wait.
+func checkLogin(r *http.Request, username, password string) (bool, time.Duration, error) {
+	now := time.Now()
+	failures, err := getLoginFailures(username, attemptLogin)
+	if err != nil {
+		return false, 0, err
+	}
+
+	var attempt *loginAttempt
+	if failures.current(now).Count > 0 {
+		var wait time.Duration
+		attempt, wait, err = reserveLoginAttempt(r, username, attemptLogin, now)
+		if err != nil || wait > 0 {
+			return false, wait, err
+		}
+	}
+
+	valid, authErr := testAuthAgainstDB(username, password)
+	if authErr != nil && authErr != errMalformedHash {
+		if attempt != nil {
+			if err = refundLoginAttempt(attempt); err != nil {
+				logError(r, err)
+			}
+		}
+		return false, 0, authErr
+	}
+
+	if valid {
+		if attempt == nil {
+			return true, 0, nil
+		}
+		return true, 0, loginSucceeded(attempt)
+	}
+
+	if attempt == nil {
+		if attempt, err = recordLoginFailure(r, username, attemptLogin, now); err != nil {
+			logError(r, err)
+			return false, 0, authErr
+		}
+	}
+	logLoginFailure(r, attempt)
+	return false, attempt.addressWait, authErr
+}
@@ -10,11 +10,16 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type siteConfig struct {
-	DatabasePath string
-	ListenURL    string
+	DatabasePath         string
+	ListenURL            string
+	MaxWeeklyLossPercent float64
+	MinCaloriesMale      int
+	MinCaloriesFemale    int
+	TrustedProxies       []string
 }
 
 var config = siteConfig{}
@@ -41,11 +46,34 @@ func main() {
 		return
 	}
 
+	if len(os.Args) == 3 && os.Args[1] == "--unlock-user" {
+		err := unlockUser(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("user unlocked successfully")
+		return
+	}
+
+	if len(os.Args) == 3 && os.Args[1] == "--reset-totp" {
+		err := resetUserTOTP(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("two-factor authentication reset successfully")
+		return
+	}
+
+	err = syncAllCategories()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	setupRoutes() // configure handlers for url fragments
 
 	openingMessage := fmt.Sprintf("Application started! Listening locally at port %s", config.ListenURL)
 	log.Println(openingMessage)
-	log.Println(http.ListenAndServe(config.ListenURL, globalHandler(http.DefaultServeMux)))
+	log.Println(http.ListenAndServe(config.ListenURL, withRequestID(withRecovery(globalHandler(http.DefaultServeMux)))))
 }
 
 func loadConfig() {
@@ -58,10 +86,24 @@ func loadConfig() {
 		log.Fatal(err)
 	}
 
+	if config.MaxWeeklyLossPercent == 0 {
+		config.MaxWeeklyLossPercent = defaultMaxWeeklyLossPercent
+	}
+	if config.MinCaloriesMale == 0 {
+		config.MinCaloriesMale = defaultMinCaloriesMale
+	}
+	if config.MinCaloriesFemale == 0 {
+		config.MinCaloriesFemale = defaultMinCaloriesFemale
+	}
+
 	verificationErrors := ""
 	if _, err := os.Stat(config.DatabasePath); os.IsNotExist(err) {
 		verificationErrors += fmt.Sprintf("database file not found at path '%s'", config.DatabasePath)
 	}
+	trustedProxies, err = parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		verificationErrors += err.Error()
+	}
 
 	if verificationErrors != "" {
 		log.Fatal(verificationErrors)
@@ -72,15 +114,37 @@ func globalHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		user, pass, ok := r.BasicAuth()
-		valid, err := testAuthAgainstDB(user, pass)
-		if err != nil {
-			log.Fatal(err)
+		valid := false
+		if ok {
+			var wait time.Duration
+			var err error
+			valid, wait, err = checkLogin(r, user, pass)
+			if wait > 0 {
+				writeTooManyAttempts(w, r, wait)
+				return
+			}
+			if err == errMalformedHash {
+				// a broken hash locks out only its own user, as a wrong password would
+				logError(r, fmt.Errorf("%s for user %s", err, user))
+			} else if err != nil {
+				serverError(w, r, err)
+				return
+			}
 		}
 
-		if !ok || !valid {
+		if !valid {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Hack Weight Authentication"`)
-			w.WriteHeader(401)
-			w.Write([]byte("Unauthorised.\n"))
+			writeError(w, r, http.StatusUnauthorized, errorResponse{Code: codeUnauthorised, Message: "unauthorised"})
+			return
+		}
+
+		needsCode, err := needsSecondFactor(r, user)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if needsCode {
+			writeSecondFactorRequired(w, r)
 			return
 		}
 
@@ -92,7 +156,7 @@ func globalHandler(h http.Handler) http.Handler {
 		headers.Set("X-Content-Type-Options", "nosniff")
 
 		csp := "default-src 'none';"
-		csp += "script-src 'self' https://use.fontawesome.com https://cdn.jsdelivr.net/npm/chart.js@2.8.0;"
+		csp += "script-src 'self' https://use.fontawesome.com;"
 		csp += "style-src 'self' 'unsafe-inline' https://use.fontawesome.com;"
 		csp += "font-src 'self' https://use.fontawesome.com;"
 		csp += "connect-src 'self';"
@@ -101,6 +165,10 @@ func globalHandler(h http.Handler) http.Handler {
 		headers.Set("Content-Security-Policy", csp)
 
 		h.ServeHTTP(w, r.WithContext(userCtx))
+
+		if r.Method != "GET" {
+			invalidateCharts(user)
+		}
 	})
 }
 
@@ -108,15 +176,74 @@ func setupRoutes() {
 	http.HandleFunc("/", indexHandler) // note: this will catch any request not caught by the others
 	http.Handle("/static/", runtimeStaticHandler())
 
-	http.HandleFunc("/today/weight", weightHandler)
-	http.HandleFunc("/today/calories", caloriesHandler)
+	http.HandleFunc("/today/weight", withAchievements(weightHandler))
+	http.HandleFunc("/today/calories", withAchievements(caloriesHandler))
 	http.HandleFunc("/calories/delete", deleteEntryHandler)
+	http.HandleFunc("/calories/copy", withAchievements(copyCaloriesHandler))
+	http.HandleFunc("/today/exercise", addExerciseHandler)
+	http.HandleFunc("/exercise", exerciseHandler)
+	http.HandleFunc("/exercise/delete", deleteExerciseHandler)
+	http.HandleFunc("/exercise/activities", activitiesHandler)
+	http.HandleFunc("/today/rung", rungHandler)
+	http.HandleFunc("/ladder", ladderHandler)
+	http.HandleFunc("/ladder/status", ladderStatusHandler)
+	http.HandleFunc("/today/drinks", withAchievements(addDrinkHandler))
+	http.HandleFunc("/drinks", drinksHandler)
+	http.HandleFunc("/drinks/delete", deleteDrinkHandler)
+	http.HandleFunc("/drinks/settings", drinksSettingsHandler)
+	http.HandleFunc("/drinks/summary", drinksSummaryHandler)
+	http.HandleFunc("/today/intake", addIntakeHandler)
+	http.HandleFunc("/intake", intakeHandler)
+	http.HandleFunc("/intake/delete", deleteIntakeHandler)
+	http.HandleFunc("/intake/targets", intakeTargetHandler)
+	http.HandleFunc("/today/measurements", addMeasurementHandler)
+	http.HandleFunc("/measurements", measurementsHandler)
+	http.HandleFunc("/measurements/delete", deleteMeasurementHandler)
+	http.HandleFunc("/measurements/trend", measurementTrendHandler)
+	http.HandleFunc("/measurements/derived", derivedMetricsHandler)
 	http.HandleFunc("/today", todayHandler)
 	http.HandleFunc("/categories", categoriesHandler)
+	http.HandleFunc("/categories/all", allCategoriesHandler)
+	http.HandleFunc("/categories/update", updateCategoryHandler)
+	http.HandleFunc("/categories/rename", renameCategoryHandler)
+	http.HandleFunc("/categories/merge", mergeCategoriesHandler)
 	http.HandleFunc("/goals", goalsHandler)
+	http.HandleFunc("/goals/history", goalHistoryHandler)
+	http.HandleFunc("/goals/phases", planGoalHandler)
+	http.HandleFunc("/goals/phases/delete", deletePlannedGoalHandler)
+	http.HandleFunc("/profile", profileHandler)
+	http.HandleFunc("/profile/password", changePasswordHandler)
+	http.HandleFunc("/profile/totp", totpStatusHandler)
+	http.HandleFunc("/profile/totp/enrol", enrolTOTPHandler)
+	http.HandleFunc("/profile/totp/confirm", confirmTOTPHandler)
+	http.HandleFunc("/profile/totp/disable", disableTOTPHandler)
+	http.HandleFunc(totpLoginPath, totpLoginHandler)
+	http.HandleFunc("/achievements", achievementsHandler)
 	http.HandleFunc("/history", historyHandler)
 	http.HandleFunc("/history/trend", trendHandler)
+	http.HandleFunc("/history/trend.svg", trendSVGHandler)
+	http.HandleFunc("/history/trend.png", pngChartHandler(loadChartData, renderTrendPNG, "trend"))
+	http.HandleFunc("/history/calories.png", pngChartHandler(loadCalorieChartData, renderCaloriesPNG, "calories"))
+	http.HandleFunc("/history/budgets", budgetHistoryHandler)
 	http.HandleFunc("/history/clear", clearAllEntriesHandler)
+	http.HandleFunc("/reports/weekly", reportHandler(weekStart, weekEnd))
+	http.HandleFunc("/reports/monthly", reportHandler(monthStart, monthEnd))
+	http.HandleFunc("/reports/pdf", pdfReportHandler)
+
+	http.HandleFunc("/foods", foodsHandler)
+	http.HandleFunc("/foods/delete", deleteFoodHandler)
+	http.HandleFunc("/recipes", recipesHandler)
+	http.HandleFunc("/recipes/delete", deleteRecipeHandler)
+	http.HandleFunc("/recipes/ingredients", ingredientHandler)
+	http.HandleFunc("/recipes/ingredients/delete", deleteIngredientHandler)
+	http.HandleFunc("/recipes/log", withAchievements(logRecipeHandler))
+
+	http.HandleFunc("/templates", templatesHandler)
+	http.HandleFunc("/templates/delete", deleteTemplateHandler)
+	http.HandleFunc("/templates/log", withAchievements(logTemplateHandler))
+
+	setupAPIRoutes()
+	http.HandleFunc(apiPrefix+"/", apiHandler)
 }
 
 func runtimeStaticHandler() http.Handler {
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDatabase points the global database at a new one with just the
+// tables logging in needs, and puts the old one back when the test is done.
+// Failures counted against addresses by earlier tests are forgotten.
+func openTestDatabase(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema := []string{
+		"CREATE TABLE users ( username string primary key, password string not null )",
+		"CREATE TABLE login_attempt ( username string not null, kind string not null, failures integer not null, last_failure string not null, primary key (username, kind) )",
+		"CREATE TABLE totp ( username string primary key, secret string not null, enabled integer not null, last_step integer not null )",
+		"CREATE TABLE recovery_code ( id integer primary key, username string not null, code_hash string not null )",
+		"CREATE TABLE session ( token_hash string primary key, username string not null, expires string not null )",
+	}
+	for _, statement := range schema {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := database
+	database = db
+	addressFailures = make(map[string]loginFailures)
+	t.Cleanup(func() {
+		database = previous
+		db.Close()
+	})
+	return db
+}
+
+func addTestUser(t *testing.T, db *sql.DB, username, hash string) {
+	if _, err := db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", username, hash); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestServer serves the handler the way main does, minus the request ids.
+func newTestServer(h http.Handler) *httptest.Server {
+	return httptest.NewServer(withRecovery(globalHandler(h)))
+}
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// get requests a path as the given user, returning the status and, for
+// errors, the error code.
+func get(t *testing.T, server *httptest.Server, path, username, password string) (int, string) {
+	return request(t, server, "GET", path, username, password, nil)
+}
+
+// post is get for posting a form.
+func post(t *testing.T, server *httptest.Server, path, username, password string, form url.Values) (int, string) {
+	return request(t, server, "POST", path, username, password, form)
+}
+
+func request(t *testing.T, server *httptest.Server, method, path, username, password string, form url.Values) (int, string) {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	req.Header.Set("Accept", mimeJSON)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var body errorResponse
+	if res.StatusCode >= 400 {
+		if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: error response isn't JSON: %v", path, err)
+		}
+	}
+	return res.StatusCode, body.Code
+}
+
+func TestMalformedHashIsUnauthorised(t *testing.T) {
+	db := openTestDatabase(t)
+	hash, err := generateArgonHash(passwordConfig, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestUser(t, db, "good", hash)
+	addTestUser(t, db, "truncated", hash[:len(hash)/2])
+	addTestUser(t, db, "expensive", "$argon2id$v=19$m=4294967295,t=4294967295,p=255$c2FsdA$a2V5")
+
+	server := newTestServer(http.HandlerFunc(okHandler))
+	defer server.Close()
+
+	for _, username := range []string{"truncated", "expensive"} {
+		if status, code := get(t, server, "/", username, "password"); status != http.StatusUnauthorized || code != codeUnauthorised {
+			t.Errorf("%s: got %d %s, want %d %s", username, status, code, http.StatusUnauthorized, codeUnauthorised)
+		}
+	}
+
+	if status, _ := get(t, server, "/", "good", "password"); status != http.StatusOK {
+		t.Errorf("good user after malformed hashes: got %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestDatabaseFailureIsServerError(t *testing.T) {
+	db := openTestDatabase(t)
+	server := newTestServer(http.HandlerFunc(okHandler))
+	defer server.Close()
+
+	if _, err := db.Exec("DROP TABLE users"); err != nil {
+		t.Fatal(err)
+	}
+	if status, code := get(t, server, "/", "someone", "password"); status != http.StatusInternalServerError || code != codeServerError {
+		t.Errorf("missing table: got %d %s, want %d %s", status, code, http.StatusInternalServerError, codeServerError)
+	}
+
+	db.Close()
+	if status, code := get(t, server, "/", "someone", "password"); status != http.StatusInternalServerError || code != codeServerError {
+		t.Errorf("closed database: got %d %s, want %d %s", status, code, http.StatusInternalServerError, codeServerError)
+	}
+
+	// still serving, and still turning away requests that don't log in
+	if status, code := get(t, server, "/", "", ""); status != http.StatusUnauthorized || code != codeUnauthorised {
+		t.Errorf("after failures: got %d %s, want %d %s", status, code, http.StatusUnauthorized, codeUnauthorised)
+	}
+}
+
+func TestPanicIsServerError(t *testing.T) {
+	db := openTestDatabase(t)
+	hash, err := generateArgonHash(passwordConfig, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestUser(t, db, "good", hash)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	})
+	mux.HandleFunc("/", okHandler)
+	server := newTestServer(mux)
+	defer server.Close()
+
+	if status, code := get(t, server, "/panic", "good", "password"); status != http.StatusInternalServerError || code != codeServerError {
+		t.Errorf("panic: got %d %s, want %d %s", status, code, http.StatusInternalServerError, codeServerError)
+	}
+	if status, _ := get(t, server, "/", "good", "password"); status != http.StatusOK {
+		t.Errorf("after panic: got %d, want %d", status, http.StatusOK)
+	}
+}
+
+// The wait after failed logins holds back the right password too, but once
+// it's over the right password gets in and forgets the failures, so the real
+// user isn't left waiting on every request after.
+func TestRightPasswordClearsFailures(t *testing.T) {
+	db := openTestDatabase(t)
+	hash, err := generateArgonHash(testPasswordConfig, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestUser(t, db, "someone", hash)
+
+	server := newTestServer(http.HandlerFunc(okHandler))
+	defer server.Close()
+
+	for i := 1; i <= loginFreeAttempts; i++ {
+		if status, code := get(t, server, "/", "someone", "wrong"); status != http.StatusUnauthorized || code != codeUnauthorised {
+			t.Fatalf("wrong password %d: got %d %s, want %d %s", i, status, code, http.StatusUnauthorized, codeUnauthorised)
+		}
+	}
+	if status, code := get(t, server, "/", "someone", "password"); status != http.StatusTooManyRequests || code != codeTooManyRequests {
+		t.Errorf("right password while waiting: got %d %s, want %d %s", status, code, http.StatusTooManyRequests, codeTooManyRequests)
+	}
+
+	// move the failures back past the wait, as if it had passed
+	last := time.Now().Add(-loginMaxBackoff).Format(time.RFC3339)
+	if _, err = db.Exec("UPDATE login_attempt SET last_failure = ? WHERE username = ?", last, "someone"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if status, _ := get(t, server, "/", "someone", "password"); status != http.StatusOK {
+			t.Errorf("right password %d after waiting: got %d, want %d", i, status, http.StatusOK)
+		}
+	}
+
+	failures, err := getLoginFailures("someone", attemptLogin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures.Count != 0 {
+		t.Errorf("got %d failures after logging in, want 0", failures.Count)
+	}
+}
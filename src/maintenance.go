@@ -0,0 +1,57 @@
+package main
+
+import "math"
+
+// In maintenance the target weight is the middle of a band rather than a
+// point to reach by a date. A single day's weight is too noisy to act on, so
+// it's the trend that's watched, and once it leaves the band the user is told
+// how much to adjust their eating by to bring it back to the target.
+
+const defaultMaintenanceBand = 1.0 // kg either side of the target
+
+// corrections are spread over four weeks, which keeps them small enough to
+// stick to
+const correctionDays = 28
+
+type maintenanceStatus struct {
+	Trend      float64
+	BandMin    float64
+	BandMax    float64
+	Drift      float64
+	Correction int
+}
+
+// calcMaintenanceStatus compares the trend with the band of a maintenance
+// goal. Drift is how far outside the band the trend is, and Correction the
+// change in daily calories that would bring it back to the target.
+func calcMaintenanceStatus(goals goals, trend float64) *maintenanceStatus {
+	if goals.Kind != "maintain" || goals.TargetWeight == 0 || trend == 0 {
+		return nil
+	}
+	band := goals.Band
+	if band == 0 {
+		band = defaultMaintenanceBand
+	}
+
+	result := maintenanceStatus{Trend: trend, BandMin: goals.TargetWeight - band, BandMax: goals.TargetWeight + band}
+	if trend > result.BandMax {
+		result.Drift = trend - result.BandMax
+	} else if trend < result.BandMin {
+		result.Drift = trend - result.BandMin
+	}
+	if result.Drift != 0 {
+		result.Correction = -int(math.Round((trend - goals.TargetWeight) * 7700 / correctionDays))
+	}
+	result.Drift = math.Round(result.Drift*100) / 100
+	return &result
+}
+
+// maintenanceBurnRate falls back on the estimate from the user's profile for
+// a maintenance goal set without a burn rate of its own.
+func maintenanceBurnRate(username string) (int, error) {
+	summary, err := getProfileSummary(username)
+	if err != nil {
+		return 0, err
+	}
+	return summary.SuggestedBurnRate, nil
+}
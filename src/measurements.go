@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// bodyMetrics are the measurements that can be recorded, with their units.
+var bodyMetrics = map[string]string{
+	"waist":       "cm",
+	"hips":        "cm",
+	"chest":       "cm",
+	"neck":        "cm",
+	"body_fat":    "%",
+	"muscle_mass": "kg",
+}
+
+type measurement struct {
+	ID    int
+	Date  string
+	Value float64
+}
+
+type metricTrendEntry struct {
+	Date     string
+	Recorded float64
+	Weighted float64
+}
+
+type derivedMetrics struct {
+	Weight       float64
+	BodyFat      float64
+	NavyBodyFat  float64
+	LeanBodyMass float64
+}
+
+func setMeasurement(day time.Time, metric string, value float64, username string) error {
+	start, end := getDayStartAndEnd(day)
+	date := day.Format(time.RFC3339)
+
+	// one value per metric per day, so a re-measure replaces the earlier one
+	res, err := database.Exec("UPDATE body_measurement SET date = ?, value = ? WHERE metric = ? AND date >= ? AND date <= ? AND username = ?",
+		date, value, metric, start, end, username)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil || rows != 0 {
+		return err
+	}
+	_, err = database.Exec("INSERT INTO body_measurement (date, metric, value, username) VALUES (?, ?, ?, ?)", date, metric, value, username)
+	return err
+}
+
+func deleteMeasurement(id int, username string) error {
+	_, err := database.Exec("DELETE FROM body_measurement WHERE id = ? AND username = ?", id, username)
+	return err
+}
+
+func getMeasurements(metric, username string) ([]measurement, error) {
+	rows, err := database.Query("SELECT id, date, value FROM body_measurement WHERE metric = ? AND username = ? ORDER BY date", metric, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]measurement, 0)
+	for rows.Next() {
+		var m measurement
+		err = rows.Scan(&m.ID, &m.Date, &m.Value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+
+	return result, nil
+}
+
+func getLatestMeasurements(username string) (map[string]float64, error) {
+	rows, err := database.Query(`
+		SELECT m.metric, m.value FROM body_measurement m
+		WHERE m.username = ? AND m.date = (SELECT MAX(date) FROM body_measurement WHERE metric = m.metric AND username = m.username)`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]float64)
+	for rows.Next() {
+		var metric string
+		var value float64
+		err = rows.Scan(&metric, &value)
+		if err != nil {
+			return nil, err
+		}
+		result[metric] = value
+	}
+
+	return result, nil
+}
+
+func calcMetricTrend(measurements []measurement) []metricTrendEntry {
+	values := make([]float64, len(measurements))
+	for i, m := range measurements {
+		values[i] = m.Value
+	}
+	weighted := calcTrend(values)
+
+	result := make([]metricTrendEntry, 0, len(measurements))
+	for i, m := range measurements {
+		result = append(result, metricTrendEntry{m.Date[:10], m.Value, weighted[i]})
+	}
+	return result
+}
+
+// calcNavyBodyFat is the US Navy circumference method, which estimates body
+// fat from neck and waist (plus hips for women) and height, all in cm.
+func calcNavyBodyFat(sex string, height, waist, neck, hips float64) float64 {
+	var result float64
+	if sex == "male" && waist > neck {
+		result = 495/(1.0324-0.19077*math.Log10(waist-neck)+0.15456*math.Log10(height)) - 450
+	} else if sex == "female" && waist+hips > neck && hips > 0 {
+		result = 495/(1.29579-0.35004*math.Log10(waist+hips-neck)+0.22100*math.Log10(height)) - 450
+	}
+	if result <= 0 || math.IsNaN(result) {
+		return 0
+	}
+	return math.Round(result*10) / 10
+}
+
+// calcDerivedMetrics works out lean body mass from the latest weight and body
+// fat, preferring a measured body fat (e.g. from scales) over the estimate.
+func calcDerivedMetrics(weight float64, latest map[string]float64, sex string, height float64) derivedMetrics {
+	result := derivedMetrics{Weight: weight, BodyFat: latest["body_fat"]}
+	if height > 0 && latest["waist"] > 0 && latest["neck"] > 0 {
+		result.NavyBodyFat = calcNavyBodyFat(sex, height, latest["waist"], latest["neck"], latest["hips"])
+	}
+
+	bodyFat := result.BodyFat
+	if bodyFat == 0 {
+		bodyFat = result.NavyBodyFat
+	}
+	if weight > 0 && bodyFat > 0 {
+		result.LeanBodyMass = math.Round(weight*(1-bodyFat/100)*10) / 10
+	}
+	return result
+}
+
+func addMeasurementHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	metric := r.FormValue("metric")
+	if _, exists := bodyMetrics[metric]; !exists {
+		invalidField(w, r, "metric", "unknown metric")
+		return
+	}
+
+	value, ok := formFloat(r, "value")
+	if !ok || value <= 0 || (bodyMetrics[metric] == "%" && value >= 100) {
+		invalidField(w, r, "value", "value must be a number greater than 0, and percentages less than 100")
+		return
+	}
+
+	err := setMeasurement(time.Now(), metric, math.Round(value*10)/10, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func deleteMeasurementHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	err := deleteMeasurement(id, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func measurementsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	metric := r.FormValue("metric")
+	if _, exists := bodyMetrics[metric]; !exists {
+		invalidField(w, r, "metric", "unknown metric")
+		return
+	}
+
+	result, err := getMeasurements(metric, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(result)
+	case mimeText:
+		for _, m := range result {
+			fmt.Fprintf(w, "%d\t%s\t%g%s\n", m.ID, m.Date, m.Value, bodyMetrics[metric])
+		}
+	}
+}
+
+func measurementTrendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	metric := r.FormValue("metric")
+	if _, exists := bodyMetrics[metric]; !exists {
+		invalidField(w, r, "metric", "unknown metric")
+		return
+	}
+
+	measurements, err := getMeasurements(metric, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	result := calcMetricTrend(measurements)
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(result)
+	case mimeText:
+		for _, entry := range result {
+			fmt.Fprintf(w, "%s\n%f\n%f\n\n", entry.Date, entry.Recorded, entry.Weighted)
+		}
+	}
+}
+
+// derivedMetricsHandler uses the sex and height from the user's profile for
+// the body fat estimate.
+func derivedMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	currentUser := currentUser(r)
+	weight, err := getLatestWeight(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	profile, err := getProfile(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	latest, err := getLatestMeasurements(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	result := calcDerivedMetrics(weight, latest, profile.Sex, profile.Height)
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(result)
+	case mimeText:
+		fmt.Fprintln(w, result.Weight)
+		fmt.Fprintln(w, result.BodyFat)
+		fmt.Fprintln(w, result.NavyBodyFat)
+		fmt.Fprintln(w, result.LeanBodyMass)
+	}
+}
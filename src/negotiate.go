@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses are negotiated on the Accept header. Handlers offer the types
+// they can produce, most preferred first, and write whichever is chosen.
+// Clients that don't say, or accept anything, get the first offer.
+
+const (
+	mimeJSON = "application/json"
+	mimeText = "text/plain"
+	mimeCSV  = "text/csv"
+)
+
+// responseTypes are the Content-Type headers sent for each offer.
+var responseTypes = map[string]string{
+	mimeJSON: "application/json",
+	mimeText: "text/plain; charset=utf-8",
+	mimeCSV:  "text/csv; charset=utf-8",
+}
+
+// downloadFormats are the formats that can be asked for by name in a link,
+// where the Accept header can't be set, and the file extension for each.
+var downloadFormats = map[string]struct {
+	mime      string
+	extension string
+}{
+	"json": {mimeJSON, "json"},
+	"text": {mimeText, "txt"},
+	"csv":  {mimeCSV, "csv"},
+}
+
+type acceptedType struct {
+	mime    string
+	quality float64
+}
+
+func parseAccept(header string) []acceptedType {
+	result := []acceptedType{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		accepted := acceptedType{strings.ToLower(strings.TrimSpace(params[0])), 1}
+		if accepted.mime == "" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					accepted.quality = q
+				}
+			}
+		}
+		result = append(result, accepted)
+	}
+	return result
+}
+
+func (a acceptedType) matches(offer string) bool {
+	if a.mime == "*/*" || a.mime == offer {
+		return true
+	}
+	return strings.HasSuffix(a.mime, "/*") && strings.HasPrefix(offer, a.mime[:len(a.mime)-1])
+}
+
+// specificity ranks exact types over type/* over */*, so the most specific
+// range matching an offer decides its quality.
+func (a acceptedType) specificity() int {
+	if a.mime == "*/*" {
+		return 0
+	}
+	if strings.HasSuffix(a.mime, "/*") {
+		return 1
+	}
+	return 2
+}
+
+// negotiate picks the offer that best suits the Accept header, or returns
+// false if none of them are acceptable. Each offer takes the quality of the
+// most specific range that matches it, so "text/csv;q=0, */*" excludes CSV
+// even though the wildcard would allow it.
+func negotiate(r *http.Request, offers ...string) (string, bool) {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return offers[0], true
+	}
+
+	accepted := parseAccept(header)
+	best, bestQuality := "", 0.0
+	for _, offer := range offers {
+		quality, specificity := 0.0, -1
+		for _, a := range accepted {
+			if a.matches(offer) && a.specificity() > specificity {
+				quality, specificity = a.quality, a.specificity()
+			}
+		}
+		if quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+	return best, best != ""
+}
+
+// negotiateResponse sets the Content-Type for the negotiated offer and
+// returns it. If none are acceptable it responds with 406 and returns "", so
+// that a switch on the result simply writes nothing further.
+func negotiateResponse(w http.ResponseWriter, r *http.Request, offers ...string) string {
+	offer, ok := negotiate(r, offers...)
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, errorResponse{Code: codeNotAcceptable, Message: "not acceptable, try one of: " + strings.Join(offers, ", ")})
+		return ""
+	}
+	w.Header().Set("Content-Type", responseTypes[offer])
+	return offer
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// buildOpenAPI describes the API routes as an OpenAPI 3 document. Request and
+// response schemas are worked out from the Go types themselves, following the
+// same rules as encoding/json, so they match what is actually sent.
+func buildOpenAPI(routes []apiRoute) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	openAPISchema(reflect.TypeOf(errorResponse{}), schemas)
+	errorResponse := map[string]interface{}{
+		"description": "error",
+		"content":     jsonContent(map[string]interface{}{"$ref": "#/components/schemas/errorResponse"}),
+	}
+
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		operation := map[string]interface{}{"summary": route.Summary}
+
+		parameters := []interface{}{}
+		if strings.Contains(route.Path, "{id}") {
+			parameters = append(parameters, map[string]interface{}{
+				"name": "id", "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "integer"},
+			})
+		}
+		for _, name := range route.Query {
+			parameters = append(parameters, map[string]interface{}{
+				"name": name, "in": "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(openAPISchema(reflect.TypeOf(route.Request), schemas)),
+			}
+		}
+
+		response := map[string]interface{}{"description": http.StatusText(route.Status)}
+		if route.Response != nil {
+			response["content"] = jsonContent(openAPISchema(reflect.TypeOf(route.Response), schemas))
+		}
+		operation["responses"] = map[string]interface{}{
+			strconv.Itoa(route.Status): response,
+			"default":                  errorResponse,
+		}
+
+		path, _ := paths[route.Path].(map[string]interface{})
+		if path == nil {
+			path = make(map[string]interface{})
+			paths[route.Path] = path
+		}
+		path[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Hack Weight",
+			"version": "1",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": apiPrefix}},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"basic": map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"basic": []interface{}{}}},
+		"paths":    paths,
+	}
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{mimeJSON: map[string]interface{}{"schema": schema}}
+}
+
+// openAPISchema returns the schema for a type. Named structs are added to
+// schemas and referred to, everything else is described inline.
+func openAPISchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := openAPISchema(t.Elem(), schemas)
+		if _, isRef := schema["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return openAPIObject(t, schemas)
+		}
+		if _, exists := schemas[t.Name()]; !exists {
+			schemas[t.Name()] = nil // placeholder, in case the type refers to itself
+			schemas[t.Name()] = openAPIObject(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func openAPIObject(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	addOpenAPIProperties(t, properties, schemas)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// addOpenAPIProperties adds the exported fields of a struct, with the fields
+// of embedded structs flattened in, as encoding/json does.
+func addOpenAPIProperties(t reflect.Type, properties, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+				name = tagName
+			}
+		}
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == "" {
+			addOpenAPIProperties(field.Type, properties, schemas)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		properties[name] = openAPISchema(field.Type, schemas)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+const minPasswordLength = 8
+
+// changePasswordHandler needs the current password as well as the new one,
+// so that a browser left logged in can't be used to take over the account.
+// Guesses at it count as failed logins. Browsers hold on to basic auth
+// credentials, so after a change they'll ask to log in again.
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	current, next := r.FormValue("current_password"), r.FormValue("new_password")
+	if utf8.RuneCountInString(next) < minPasswordLength {
+		invalidField(w, r, "new_password", fmt.Sprintf("new password must be at least %d characters", minPasswordLength))
+		return
+	}
+
+	currentUser := currentUser(r)
+	passwordHash, err := getPasswordHash(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	attempt, wait, err := reserveLoginAttempt(r, currentUser, attemptConfirm, time.Now())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, r, wait)
+		return
+	}
+
+	valid, err := compareWithArgonHash(current, passwordHash)
+	if err != nil {
+		if refundErr := refundLoginAttempt(attempt); refundErr != nil {
+			logError(r, refundErr)
+		}
+		serverError(w, r, err)
+		return
+	}
+	if !valid {
+		logLoginFailure(r, attempt)
+		if attempt.addressWait > 0 {
+			writeTooManyAttempts(w, r, attempt.addressWait)
+			return
+		}
+		invalidField(w, r, "current_password", "current password is incorrect")
+		return
+	}
+
+	err = loginSucceeded(attempt)
+	if err == nil {
+		err = updatePassword(currentUser, next, passwordHash)
+	}
+	if err == errPasswordChanged {
+		writeError(w, r, http.StatusConflict, errorResponse{Code: codeConflict, Message: "password has been changed since it was checked, try again"})
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A minimal PDF writer, just enough for printable reports: pages of text,
+// lines and filled rectangles, using the built in Helvetica fonts so nothing
+// has to be embedded. Positions are in points from the top left of an A4
+// page, and are flipped into PDF's bottom left origin as they're written.
+
+const pdfPageWidth = 595.0
+const pdfPageHeight = 842.0
+
+type pdfDocument struct {
+	pages []*pdfPage
+}
+
+type pdfPage struct {
+	content bytes.Buffer
+}
+
+func (d *pdfDocument) newPage() *pdfPage {
+	page := &pdfPage{}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// pdfColour turns a #rrggbb colour into PDF's 0 to 1 components.
+func pdfColour(hex string) string {
+	value, _ := strconv.ParseUint(hex[1:], 16, 32)
+	return fmt.Sprintf("%.3f %.3f %.3f", float64(value>>16&0xff)/255, float64(value>>8&0xff)/255, float64(value&0xff)/255)
+}
+
+// pdfEscape makes text safe for a PDF string. The standard fonts only cover
+// Latin characters, so anything else is replaced.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(c)
+		case c < 32 || c > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// textWidth is an estimate, as the font metrics aren't available, but close
+// enough to right align numbers and centre headings.
+func textWidth(s string, size float64) float64 {
+	return float64(len(s)) * size * 0.52
+}
+
+// text draws a string with its baseline at y, aligned on x to the left,
+// centre or right depending on align being negative, zero or positive.
+func (p *pdfPage) text(x, y, size float64, s string, bold bool, align int) {
+	if align == 0 {
+		x -= textWidth(s, size) / 2
+	} else if align > 0 {
+		x -= textWidth(s, size)
+	}
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %g Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pdfPageHeight-y, pdfEscape(s))
+}
+
+func (p *pdfPage) line(x0, y0, x1, y1, width float64, dash float64, colour string) {
+	if dash > 0 {
+		fmt.Fprintf(&p.content, "[%g %g] 0 d ", dash, dash)
+	}
+	fmt.Fprintf(&p.content, "%s RG %g w %.2f %.2f m %.2f %.2f l S", pdfColour(colour), width, x0, pdfPageHeight-y0, x1, pdfPageHeight-y1)
+	if dash > 0 {
+		p.content.WriteString(" [] 0 d")
+	}
+	p.content.WriteString("\n")
+}
+
+// polyline joins up points given as alternating x and y values.
+func (p *pdfPage) polyline(points []float64, width float64, colour string) {
+	if len(points) < 4 {
+		return
+	}
+	fmt.Fprintf(&p.content, "%s RG %g w %.2f %.2f m", pdfColour(colour), width, points[0], pdfPageHeight-points[1])
+	for i := 2; i+1 < len(points); i += 2 {
+		fmt.Fprintf(&p.content, " %.2f %.2f l", points[i], pdfPageHeight-points[i+1])
+	}
+	p.content.WriteString(" S\n")
+}
+
+func (p *pdfPage) rect(x, y, width, height float64, colour string) {
+	fmt.Fprintf(&p.content, "%s rg %.2f %.2f %.2f %.2f re f\n", pdfColour(colour), x, pdfPageHeight-y-height, width, height)
+}
+
+// write lays out the document as numbered objects followed by the cross
+// reference table that says where each one starts.
+func (d *pdfDocument) write(w io.Writer) error {
+	var b bytes.Buffer
+	offsets := []int{}
+	object := func(body string) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	b.WriteString("%PDF-1.4\n")
+
+	// objects 1 to 4 are the catalog, page tree and fonts, then each page
+	// is followed by its content stream
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+i*2)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+i*2))
+
+		var compressed bytes.Buffer
+		z := zlib.NewWriter(&compressed)
+		if _, err := z.Write(page.content.Bytes()); err != nil {
+			return err
+		}
+		if err := z.Close(); err != nil {
+			return err
+		}
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.String()))
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The PDF report is meant to be printed and taken along to the doctor: a
+// summary page with the trend chart, a log sheet for each month like the
+// ones in the Hacker Diet, and a page breaking down where the calories went.
+
+const pdfMargin = 40.0
+
+type pdfReport struct {
+	doc  *pdfDocument
+	page *pdfPage
+	y    float64
+}
+
+// row moves down the page by a line of the given height, starting a new
+// page when there isn't room for it.
+func (r *pdfReport) row(height float64) float64 {
+	if r.y+height > pdfPageHeight-pdfMargin {
+		r.page = r.doc.newPage()
+		r.y = pdfMargin
+	}
+	r.y += height
+	return r.y
+}
+
+func (r *pdfReport) heading(s string) {
+	r.page = r.doc.newPage()
+	r.y = pdfMargin
+	r.page.text(pdfMargin, r.row(20), 16, s, true, -1)
+	r.y += 10
+}
+
+// columns draws a row of cells, each right aligned at the given offsets
+// apart from the first, which is left aligned.
+func (r *pdfReport) columns(offsets []float64, cells []string, bold bool) {
+	y := r.row(14)
+	for i, cell := range cells {
+		if i == 0 {
+			r.page.text(pdfMargin+offsets[i], y, 9, cell, bold, -1)
+		} else {
+			r.page.text(pdfMargin+offsets[i], y, 9, cell, bold, 1)
+		}
+	}
+}
+
+func formatKG(weight float64) string {
+	if weight == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(weight, 'f', 1, 64) + " kg"
+}
+
+func formatCalories(calories int) string {
+	if calories == 0 {
+		return "-"
+	}
+	return strconv.Itoa(calories)
+}
+
+// drawTrendPDF draws the same chart as the SVG and PNG renderers, in the
+// print colours, with its top left corner at x, y.
+func drawTrendPDF(p *pdfPage, data chartData, options chartOptions, x, y float64) {
+	l := newChartLayout(data, options)
+	theme := printTheme
+
+	if options.Calories {
+		barWidth := l.barWidth()
+		for _, point := range data.Points {
+			height := l.barHeight(point.Calories)
+			p.rect(x+l.x(point.Date)-barWidth/2, y+l.bottom-height, barWidth, height, theme.Calories)
+		}
+	}
+
+	for _, tick := range l.weightTicks() {
+		p.line(x+l.left, y+l.y(tick), x+l.right, y+l.y(tick), 0.5, 0, theme.Axis)
+		p.text(x+l.left-5, y+l.y(tick)+3, 8, formatTick(tick), false, 1)
+	}
+	for _, tick := range l.dateTicks() {
+		p.text(x+l.dateLabelX(tick), y+l.bottom+15, 8, tick.Format("2006-01-02"), false, 0)
+	}
+	p.line(x+l.left, y+l.bottom, x+l.right, y+l.bottom, 1, 0, theme.Axis)
+
+	if data.Goal != 0 {
+		p.line(x+l.left, y+l.y(data.Goal), x+l.right, y+l.y(data.Goal), 1, 4, theme.Goal)
+	}
+
+	trend := make([]float64, 0, len(data.Points)*2)
+	for _, point := range data.Points {
+		px := x + l.x(point.Date)
+		p.line(px, y+l.y(point.Recorded), px, y+l.y(point.Trend), 1, 0, point.sinkerColour(theme))
+		p.rect(px-1.5, y+l.y(point.Recorded)-1.5, 3, 3, theme.Recorded)
+		trend = append(trend, px, y+l.y(point.Trend))
+	}
+	p.polyline(trend, 1.5, theme.Trend)
+}
+
+func (r *pdfReport) summaryPage(data chartData, goals goals, profile profile, options chartOptions) {
+	r.heading("Weight Progress Report")
+
+	if len(data.Points) == 0 {
+		r.page.text(pdfMargin, r.row(14), 10, "No weights were recorded in this period.", false, -1)
+		return
+	}
+
+	first, last := data.Points[0], data.Points[len(data.Points)-1]
+	lines := [][]string{
+		{"Period", first.Date.Format("2 January 2006") + " to " + last.Date.Format("2 January 2006")},
+		{"Starting weight", formatKG(first.Recorded) + " (trend " + formatKG(first.Trend) + ")"},
+		{"Current weight", formatKG(last.Recorded) + " (trend " + formatKG(last.Trend) + ")"},
+		{"Change in trend", fmt.Sprintf("%+.1f kg", last.Trend-first.Trend)},
+	}
+	if goals.TargetWeight != 0 {
+		target := formatKG(goals.TargetWeight) + " (" + goals.Kind
+		if goals.TargetDate != "" {
+			target += " by " + goals.TargetDate
+		}
+		lines = append(lines, []string{"Target weight", target + ")"})
+	}
+	if profile.Height != 0 {
+		lines = append(lines, []string{"BMI", fmt.Sprintf("%g at start, %g now (trend)", calcBMI(first.Trend, profile.Height), calcBMI(last.Trend, profile.Height))})
+		healthyMin, healthyMax := calcHealthyWeightRange(profile.Height)
+		lines = append(lines, []string{"Healthy weight", fmt.Sprintf("%g to %g kg for a height of %g cm", healthyMin, healthyMax, profile.Height)})
+	}
+
+	for _, line := range lines {
+		y := r.row(16)
+		r.page.text(pdfMargin, y, 10, line[0], true, -1)
+		r.page.text(pdfMargin+120, y, 10, line[1], false, -1)
+	}
+
+	r.y += 20
+	drawTrendPDF(r.page, data, options, pdfMargin, r.y)
+}
+
+// logSheets follow the Hacker Diet's monthly log: each day's weight, the
+// trend, and the variance between them, along with calories and exercise.
+func (r *pdfReport) logSheets(data chartData) {
+	offsets := []float64{0, 130, 200, 270, 340, 410, 515}
+	var month string
+	for _, point := range data.Points {
+		if point.Date.Format("2006-01") != month {
+			month = point.Date.Format("2006-01")
+			r.heading(point.Date.Format("January 2006"))
+			r.columns(offsets, []string{"Date", "Weight", "Trend", "Variance", "Calories", "Budget", "Rung"}, true)
+		}
+
+		rung := "-"
+		if point.Rung != 0 {
+			rung = strconv.Itoa(point.Rung)
+		}
+		r.columns(offsets, []string{
+			point.Date.Format("Mon 2 Jan"),
+			formatKG(point.Recorded),
+			formatKG(point.Trend),
+			fmt.Sprintf("%+.1f", point.Recorded-point.Trend),
+			formatCalories(point.Calories),
+			formatCalories(point.Budget),
+			rung,
+		}, false)
+	}
+}
+
+// breakdownPage summarises each month of weigh-ins in the range, then what
+// was eaten by category, which counts every day with calories logged.
+func (r *pdfReport) breakdownPage(days, calorieDays []recordedDay, timeline goalTimeline, options chartOptions, now time.Time) {
+	r.heading("Calories")
+
+	inRange := make([]recordedDay, 0, len(days))
+	for _, day := range days {
+		if date, err := time.Parse(time.RFC3339, day.Date); err == nil && options.inRange(date) {
+			inRange = append(inRange, day)
+		}
+	}
+
+	offsets := []float64{0, 150, 230, 310, 400, 515}
+	r.columns(offsets, []string{"Month", "Avg weight", "Trend change", "Avg calories", "Under budget", "Daily deficit"}, true)
+	for _, report := range calcReports(inRange, timeline, monthStart, monthEnd, now) {
+		start, _ := time.Parse("2006-01-02", report.Start)
+		r.columns(offsets, []string{
+			start.Format("January 2006"),
+			formatKG(report.AverageWeight),
+			fmt.Sprintf("%+.1f kg", report.TrendChange),
+			formatCalories(report.AverageCalories),
+			fmt.Sprintf("%d of %d days", report.DaysUnderBudget, report.DaysLogged),
+			strconv.Itoa(report.DailyDeficit),
+		}, false)
+	}
+
+	totals := map[string]int{}
+	total, loggedDays := 0, 0
+	for _, day := range calorieDays {
+		date, err := time.Parse(time.RFC3339, day.Date)
+		if err != nil || !options.inRange(date) || len(day.Entries) == 0 {
+			continue
+		}
+		loggedDays++
+		for _, entry := range day.Entries {
+			totals[entry.Category] += entry.Amount
+			total += entry.Amount
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	categories := make([]string, 0, len(totals))
+	for category := range totals {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool { return totals[categories[i]] > totals[categories[j]] })
+
+	r.y += 30
+	r.page.text(pdfMargin, r.row(16), 12, "By category", true, -1)
+	offsets = []float64{0, 230, 340, 450}
+	r.columns(offsets, []string{"Category", "Total", "Daily average", "Share"}, true)
+	for _, category := range categories {
+		name := category
+		if name == "" {
+			name = "Uncategorised"
+		}
+		r.columns(offsets, []string{
+			name,
+			strconv.Itoa(totals[category]),
+			strconv.Itoa(totals[category] / loggedDays),
+			fmt.Sprintf("%.0f%%", math.Round(float64(totals[category])*100/float64(total))),
+		}, false)
+	}
+}
+
+func pdfReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	options, ok := parseChartOptions(r)
+	if !ok {
+		badRequest(w, r, "invalid chart options, width and height must be within range and dates in the form yyyy-mm-dd")
+		return
+	}
+	options.Width, options.Height, options.Calories = int(pdfPageWidth-2*pdfMargin), 300, true
+
+	currentUser := currentUser(r)
+	days, err := allDaysForUser(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	calorieDays, err := calorieDaysForUser(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	timeline, err := getGoalTimeline(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	profile, err := getProfile(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	data := buildChartData(days, *timeline, options)
+	report := &pdfReport{doc: &pdfDocument{}}
+	report.summaryPage(data, timeline.current, *profile, options)
+	report.logSheets(data)
+	report.breakdownPage(days, calorieDays, *timeline, options, time.Now())
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-disposition", "attachment; filename=report.pdf")
+	err = report.doc.write(w)
+	if err != nil {
+		logError(r, err)
+	}
+}
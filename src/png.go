@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// PNG charts are for the places that can't show SVG. They're drawn with the
+// standard image packages and a fixed bitmap font, so they look a little
+// plainer than the SVG, but are laid out in exactly the same way.
+//
+// Encoding a PNG is slow next to everything else the app does, so they're
+// cached until the user next changes something.
+
+type chartCache struct {
+	sync.Mutex
+	versions map[string]int
+	entries  map[string]cachedChart
+}
+
+type cachedChart struct {
+	version int
+	image   []byte
+}
+
+const maxCachedCharts = 200
+
+var pngCache = &chartCache{versions: map[string]int{}, entries: map[string]cachedChart{}}
+
+// invalidateCharts is called after any change to a user's data.
+func invalidateCharts(username string) {
+	pngCache.Lock()
+	defer pngCache.Unlock()
+	pngCache.versions[username]++
+}
+
+func cachedRender(username, key string, render func() ([]byte, error)) ([]byte, error) {
+	pngCache.Lock()
+	version := pngCache.versions[username]
+	cached, exists := pngCache.entries[username+"|"+key]
+	pngCache.Unlock()
+	if exists && cached.version == version {
+		return cached.image, nil
+	}
+
+	result, err := render()
+	if err != nil {
+		return nil, err
+	}
+
+	pngCache.Lock()
+	defer pngCache.Unlock()
+	if len(pngCache.entries) >= maxCachedCharts {
+		pngCache.entries = map[string]cachedChart{}
+	}
+	pngCache.entries[username+"|"+key] = cachedChart{version, result}
+	return result, nil
+}
+
+type raster struct {
+	*image.RGBA
+}
+
+func newRaster(width, height int, background color.RGBA) raster {
+	r := raster{image.NewRGBA(image.Rect(0, 0, width, height))}
+	draw.Draw(r, r.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	return r
+}
+
+// parseColour reads the #rrggbb colours of the chart theme.
+func parseColour(hex string) color.RGBA {
+	value, _ := strconv.ParseUint(hex[1:], 16, 32)
+	return color.RGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 255}
+}
+
+func (r raster) rect(x, y, width, height float64, c color.RGBA) {
+	bounds := image.Rect(int(math.Round(x)), int(math.Round(y)), int(math.Round(x+width)), int(math.Round(y+height)))
+	draw.Draw(r, bounds, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// line steps along the longer axis, stamping a square of the given width at
+// each pixel. A dash of zero draws a solid line.
+func (r raster) line(x0, y0, x1, y1 float64, width int, dash int, c color.RGBA) {
+	steps := int(math.Max(math.Abs(x1-x0), math.Abs(y1-y0)))
+	for i := 0; i <= steps; i++ {
+		if dash > 0 && (i/dash)%2 == 1 {
+			continue
+		}
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		x, y := x0+(x1-x0)*t, y0+(y1-y0)*t
+		r.rect(x-float64(width)/2, y-float64(width)/2, float64(width), float64(width), c)
+	}
+}
+
+func (r raster) circle(cx, cy, radius float64, c color.RGBA) {
+	for y := int(cy - radius); y <= int(cy+radius)+1; y++ {
+		for x := int(cx - radius); x <= int(cx+radius)+1; x++ {
+			if math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) <= radius {
+				r.Set(x, y, c)
+			}
+		}
+	}
+}
+
+// text draws a string centred vertically on y, and aligned on x to the left,
+// centre or right depending on align being negative, zero or positive.
+func (r raster) text(x, y float64, s string, align int, c color.RGBA) {
+	d := font.Drawer{Dst: r, Src: image.NewUniform(c), Face: basicfont.Face7x13}
+	width := float64(d.MeasureString(s).Round())
+	if align == 0 {
+		x -= width / 2
+	} else if align > 0 {
+		x -= width
+	}
+	d.Dot = fixed.P(int(x), int(y)+4)
+	d.DrawString(s)
+}
+
+func (r raster) encode() ([]byte, error) {
+	var b bytes.Buffer
+	err := png.Encode(&b, r)
+	return b.Bytes(), err
+}
+
+func (r raster) drawDateAxis(l chartLayout) {
+	for _, tick := range l.dateTicks() {
+		r.text(l.dateLabelX(tick), l.bottom+18, tick.Format("2006-01-02"), 0, parseColour(chartTheme.Text))
+	}
+	r.line(l.left, l.bottom, l.right, l.bottom, 1, 0, parseColour(chartTheme.Axis))
+}
+
+func renderTrendPNG(data chartData, options chartOptions) ([]byte, error) {
+	l := newChartLayout(data, options)
+	r := newRaster(options.Width, options.Height, parseColour(chartTheme.Background))
+
+	if len(data.Points) == 0 {
+		r.text(l.width/2, l.height/2, "No weights recorded", 0, parseColour(chartTheme.Text))
+		return r.encode()
+	}
+
+	if options.Calories {
+		barWidth := l.barWidth()
+		for _, p := range data.Points {
+			height := l.barHeight(p.Calories)
+			r.rect(l.x(p.Date)-barWidth/2, l.bottom-height, barWidth, height, parseColour(chartTheme.Calories))
+		}
+	}
+
+	for _, tick := range l.weightTicks() {
+		r.line(l.left, l.y(tick), l.right, l.y(tick), 1, 2, parseColour(chartTheme.Axis))
+		r.text(l.left-5, l.y(tick), formatTick(tick), 1, parseColour(chartTheme.Text))
+	}
+	r.drawDateAxis(l)
+
+	if data.Goal != 0 {
+		r.line(l.left, l.y(data.Goal), l.right, l.y(data.Goal), 1, 6, parseColour(chartTheme.Goal))
+	}
+
+	for i, p := range data.Points {
+		x := l.x(p.Date)
+		r.line(x, l.y(p.Recorded), x, l.y(p.Trend), 2, 0, parseColour(p.sinkerColour(chartTheme)))
+		r.circle(x, l.y(p.Recorded), 2.5, parseColour(chartTheme.Recorded))
+		if i > 0 {
+			previous := data.Points[i-1]
+			r.line(l.x(previous.Date), l.y(previous.Trend), x, l.y(p.Trend), 2, 0, parseColour(chartTheme.Trend))
+		}
+	}
+
+	return r.encode()
+}
+
+// renderCaloriesPNG draws each day's calories as a bar, red when over that
+// day's budget, with the budget itself as a line across the bars.
+func renderCaloriesPNG(data chartData, options chartOptions) ([]byte, error) {
+	l := newChartLayout(data, options)
+	r := newRaster(options.Width, options.Height, parseColour(chartTheme.Background))
+
+	if len(data.Points) == 0 {
+		r.text(l.width/2, l.height/2, "No days recorded", 0, parseColour(chartTheme.Text))
+		return r.encode()
+	}
+
+	for _, tick := range l.calorieTicks() {
+		r.line(l.left, l.calorieY(tick), l.right, l.calorieY(tick), 1, 2, parseColour(chartTheme.Axis))
+		r.text(l.left-5, l.calorieY(tick), strconv.Itoa(tick), 1, parseColour(chartTheme.Text))
+	}
+
+	barWidth := l.barWidth()
+	for _, p := range data.Points {
+		colour := parseColour(chartTheme.Sinker)
+		if p.Budget != 0 && p.Calories > p.Budget {
+			colour = parseColour(chartTheme.Floater)
+		}
+		y := l.calorieY(p.Calories)
+		r.rect(l.x(p.Date)-barWidth/2, y, barWidth, l.bottom-y, colour)
+	}
+
+	for i, p := range data.Points {
+		if i == 0 || p.Budget == 0 || data.Points[i-1].Budget == 0 {
+			continue
+		}
+		previous := data.Points[i-1]
+		r.line(l.x(previous.Date), l.calorieY(previous.Budget), l.x(p.Date), l.calorieY(p.Budget), 2, 0, parseColour(chartTheme.Goal))
+	}
+	r.drawDateAxis(l)
+
+	return r.encode()
+}
+
+func pngChartHandler(load func(*http.Request, chartOptions) (chartData, error), render func(chartData, chartOptions) ([]byte, error), name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			notFound(w, r)
+			return
+		}
+
+		options, ok := parseChartOptions(r)
+		if !ok {
+			badRequest(w, r, "invalid chart options, width and height must be within range and dates in the form yyyy-mm-dd")
+			return
+		}
+
+		key := fmt.Sprintf("%s|%d|%d|%s|%s|%t", name, options.Width, options.Height, options.From, options.To, options.Calories)
+		result, err := cachedRender(currentUser(r), key, func() ([]byte, error) {
+			data, err := load(r, options)
+			if err != nil {
+				return nil, err
+			}
+			return render(data, options)
+		})
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(result)
+	}
+}
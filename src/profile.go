@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// activityLevels multiply the basal metabolic rate to estimate the total
+// calories burned in a day.
+var activityLevels = map[string]float64{
+	"sedentary":   1.2,
+	"light":       1.375,
+	"moderate":    1.55,
+	"active":      1.725,
+	"very_active": 1.9,
+}
+
+// healthy BMI range, per the WHO
+const healthyBMIMin = 18.5
+const healthyBMIMax = 24.9
+
+type profile struct {
+	Height        float64
+	Sex           string
+	BirthDate     string
+	ActivityLevel string
+}
+
+type profileSummary struct {
+	profile
+	Age               int
+	BMI               float64
+	TrendBMI          float64
+	HealthyWeightMin  float64
+	HealthyWeightMax  float64
+	BMR               int
+	SuggestedBurnRate int
+}
+
+func getProfile(username string) (*profile, error) {
+	settings, err := getSettings(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var height float64
+	heightVal, exists := settings["height_cm"]
+	if exists {
+		height, err = strconv.ParseFloat(heightVal, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &profile{height, settings["sex"], settings["birth_date"], settings["activity_level"]}, nil
+}
+
+func setProfile(p profile, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	settings := [][2]string{
+		{"height_cm", strconv.FormatFloat(p.Height, 'f', -1, 64)},
+		{"sex", p.Sex},
+		{"birth_date", p.BirthDate},
+		{"activity_level", p.ActivityLevel},
+	}
+	for _, setting := range settings {
+		if err = writeSetting(tx, setting[0], setting[1], username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p profile) age(now time.Time) int {
+	birth, err := time.Parse("2006-01-02", p.BirthDate)
+	if err != nil {
+		return 0
+	}
+	age := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		age--
+	}
+	return age
+}
+
+func calcBMI(weight, height float64) float64 {
+	if weight == 0 || height == 0 {
+		return 0
+	}
+	metres := height / 100
+	return math.Round(weight/(metres*metres)*10) / 10
+}
+
+// calcBMR is the Mifflin-St Jeor equation for resting calories per day.
+func calcBMR(p profile, weight float64, now time.Time) int {
+	age := p.age(now)
+	if weight == 0 || p.Height == 0 || age == 0 {
+		return 0
+	}
+	bmr := 10*weight + 6.25*p.Height - 5*float64(age)
+	if p.Sex == "male" {
+		bmr += 5
+	} else {
+		bmr -= 161
+	}
+	return int(math.Round(bmr))
+}
+
+func calcHealthyWeightRange(height float64) (float64, float64) {
+	metres := height / 100
+	round := func(v float64) float64 { return math.Round(v*10) / 10 }
+	return round(healthyBMIMin * metres * metres), round(healthyBMIMax * metres * metres)
+}
+
+func calcProfileSummary(p profile, weight, trend float64, now time.Time) profileSummary {
+	result := profileSummary{profile: p, Age: p.age(now)}
+	result.BMI = calcBMI(weight, p.Height)
+	result.TrendBMI = calcBMI(trend, p.Height)
+	if p.Height > 0 {
+		result.HealthyWeightMin, result.HealthyWeightMax = calcHealthyWeightRange(p.Height)
+	}
+
+	// the trend is a better basis than a single day's weight, when there is one
+	if trend != 0 {
+		weight = trend
+	}
+	result.BMR = calcBMR(p, weight, now)
+	if factor, exists := activityLevels[p.ActivityLevel]; exists {
+		result.SuggestedBurnRate = int(math.Round(float64(result.BMR)*factor/10) * 10)
+	}
+	return result
+}
+
+// getLatestTrend returns the most recent smoothed weight, or zero if no
+// weights have been recorded.
+func getLatestTrend(username string) (float64, error) {
+	days, err := allDaysForUser(username)
+	if err != nil || len(days) == 0 {
+		return 0, err
+	}
+	trend := calcWeightTrend(days)
+	return trend[len(trend)-1].Weighted, nil
+}
+
+// getTrendOn returns the smoothed weight as of a day, or zero if no weights
+// had been recorded by then.
+func getTrendOn(day time.Time, username string) (float64, error) {
+	days, err := allDaysForUser(username)
+	if err != nil {
+		return 0, err
+	}
+	date := day.Format("2006-01-02")
+	result := 0.0
+	for _, entry := range calcWeightTrend(days) {
+		if entry.Date > date {
+			break
+		}
+		result = entry.Weighted
+	}
+	return result, nil
+}
+
+func getProfileSummary(username string) (*profileSummary, error) {
+	p, err := getProfile(username)
+	if err != nil {
+		return nil, err
+	}
+
+	weight, err := getLatestWeight(username)
+	if err != nil {
+		return nil, err
+	}
+
+	trend, err := getLatestTrend(username)
+	if err != nil {
+		return nil, err
+	}
+
+	result := calcProfileSummary(*p, weight, trend, time.Now())
+	return &result, nil
+}
+
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		setProfileHandler(w, r)
+	} else if r.Method == "GET" {
+		getProfileHandler(w, r)
+	} else {
+		notFound(w, r)
+	}
+}
+
+func setProfileHandler(w http.ResponseWriter, r *http.Request) {
+	p := profile{Sex: r.FormValue("sex"), BirthDate: r.FormValue("birth_date"), ActivityLevel: r.FormValue("activity_level")}
+
+	var ok bool
+	if p.Height, ok = formFloat(r, "height"); !ok || p.Height < 100 || p.Height > 250 {
+		invalidField(w, r, "height", "height must be between 100 and 250 cm")
+		return
+	}
+
+	if p.Sex != "male" && p.Sex != "female" {
+		invalidField(w, r, "sex", "sex must be male or female")
+		return
+	}
+
+	if _, err := time.Parse("2006-01-02", p.BirthDate); err != nil {
+		invalidField(w, r, "birth_date", "birth date must be in the form yyyy-mm-dd")
+		return
+	}
+	if age := p.age(time.Now()); age < 13 || age > 120 {
+		invalidField(w, r, "birth_date", "age must be between 13 and 120")
+		return
+	}
+
+	if _, exists := activityLevels[p.ActivityLevel]; !exists {
+		invalidField(w, r, "activity_level", "unknown activity level")
+		return
+	}
+
+	err := setProfile(p, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func getProfileHandler(w http.ResponseWriter, r *http.Request) {
+	summary, err := getProfileSummary(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(summary)
+	case mimeText:
+		fmt.Fprintln(w, summary.Height)
+		fmt.Fprintln(w, summary.Sex)
+		fmt.Fprintln(w, summary.BirthDate)
+		fmt.Fprintln(w, summary.ActivityLevel)
+		fmt.Fprintln(w, summary.BMI)
+		fmt.Fprintln(w, summary.TrendBMI)
+		fmt.Fprintln(w, summary.SuggestedBurnRate)
+	}
+}
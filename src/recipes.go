@@ -0,0 +1,566 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// foods are the building blocks of recipes. Nutrition values are given for
+// a portion of PortionSize units (e.g. 100 g), which lets labels be copied
+// straight off packaging.
+type food struct {
+	ID           int
+	Name         string
+	PortionSize  float64
+	Unit         string
+	Calories     float64
+	Protein      float64
+	Carbohydrate float64
+	Fat          float64
+}
+
+type nutrition struct {
+	Calories     float64
+	Protein      float64
+	Carbohydrate float64
+	Fat          float64
+}
+
+type recipeIngredient struct {
+	ID       int
+	FoodID   int
+	Food     string
+	Quantity float64
+	Unit     string
+	nutrition
+}
+
+type recipe struct {
+	ID          int
+	Name        string
+	YieldAmount float64
+	YieldUnit   string
+	Portions    int
+	Ingredients []recipeIngredient
+	Total       nutrition
+	PerPortion  nutrition
+}
+
+var errFoodInUse = errors.New("food is used by a recipe")
+
+func getFoods(username string) ([]food, error) {
+	rows, err := database.Query("SELECT id, name, portion_size, unit, calories, protein, carbohydrate, fat FROM food WHERE username = ? ORDER BY name", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]food, 0)
+	for rows.Next() {
+		var f food
+		err = rows.Scan(&f.ID, &f.Name, &f.PortionSize, &f.Unit, &f.Calories, &f.Protein, &f.Carbohydrate, &f.Fat)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+
+	return result, nil
+}
+
+func insertOrUpdateFood(f food, username string) error {
+	if f.ID != 0 {
+		_, err := database.Exec("UPDATE food SET name = ?, portion_size = ?, unit = ?, calories = ?, protein = ?, carbohydrate = ?, fat = ? WHERE id = ? AND username = ?",
+			f.Name, f.PortionSize, f.Unit, f.Calories, f.Protein, f.Carbohydrate, f.Fat, f.ID, username)
+		return err
+	}
+	_, err := database.Exec("INSERT INTO food (name, portion_size, unit, calories, protein, carbohydrate, fat, username) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		f.Name, f.PortionSize, f.Unit, f.Calories, f.Protein, f.Carbohydrate, f.Fat, username)
+	return err
+}
+
+func deleteFood(id int, username string) error {
+	var uses int
+	row := database.QueryRow(`
+		SELECT COUNT(*) FROM recipe_ingredient i JOIN recipe r ON r.id = i.recipe_id
+		WHERE i.food_id = ? AND r.username = ?`, id, username)
+	if err := row.Scan(&uses); err != nil {
+		return err
+	}
+	if uses > 0 {
+		return errFoodInUse
+	}
+
+	_, err := database.Exec("DELETE FROM food WHERE id = ? AND username = ?", id, username)
+	return err
+}
+
+func getRecipes(username string) ([]recipe, error) {
+	rows, err := database.Query("SELECT id, name, yield_amount, yield_unit, portions FROM recipe WHERE username = ? ORDER BY name", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]recipe, 0)
+	for rows.Next() {
+		var rec recipe
+		err = rows.Scan(&rec.ID, &rec.Name, &rec.YieldAmount, &rec.YieldUnit, &rec.Portions)
+		if err != nil {
+			return nil, err
+		}
+		rec.Ingredients = []recipeIngredient{}
+		result = append(result, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range result {
+		result[i].Ingredients, err = getRecipeIngredients(result[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		calcRecipeNutrition(&result[i])
+	}
+
+	return result, nil
+}
+
+func getRecipe(id int, username string) (*recipe, error) {
+	var rec recipe
+	row := database.QueryRow("SELECT id, name, yield_amount, yield_unit, portions FROM recipe WHERE id = ? AND username = ?", id, username)
+	err := row.Scan(&rec.ID, &rec.Name, &rec.YieldAmount, &rec.YieldUnit, &rec.Portions)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	rec.Ingredients, err = getRecipeIngredients(rec.ID)
+	if err != nil {
+		return nil, err
+	}
+	calcRecipeNutrition(&rec)
+	return &rec, nil
+}
+
+func getRecipeIngredients(recipeID int) ([]recipeIngredient, error) {
+	rows, err := database.Query(`
+		SELECT i.id, f.id, f.name, i.quantity, f.unit, f.portion_size, f.calories, f.protein, f.carbohydrate, f.fat
+		FROM recipe_ingredient i JOIN food f ON f.id = i.food_id
+		WHERE i.recipe_id = ? ORDER BY i.id`, recipeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]recipeIngredient, 0)
+	for rows.Next() {
+		var ing recipeIngredient
+		var f food
+		err = rows.Scan(&ing.ID, &ing.FoodID, &ing.Food, &ing.Quantity, &ing.Unit, &f.PortionSize, &f.Calories, &f.Protein, &f.Carbohydrate, &f.Fat)
+		if err != nil {
+			return nil, err
+		}
+		ing.nutrition = scaleFood(f, ing.Quantity)
+		result = append(result, ing)
+	}
+
+	return result, nil
+}
+
+// scaleFood returns the nutrition of quantity units of the given food.
+func scaleFood(f food, quantity float64) nutrition {
+	if f.PortionSize == 0 {
+		return nutrition{}
+	}
+	factor := quantity / f.PortionSize
+	return nutrition{f.Calories * factor, f.Protein * factor, f.Carbohydrate * factor, f.Fat * factor}
+}
+
+// calcRecipeNutrition totals the ingredients of a recipe and splits the total
+// across its portions. This is done on every read, so editing a food or an
+// ingredient quantity is reflected immediately.
+func calcRecipeNutrition(rec *recipe) {
+	total := nutrition{}
+	for _, ing := range rec.Ingredients {
+		total.Calories += ing.Calories
+		total.Protein += ing.Protein
+		total.Carbohydrate += ing.Carbohydrate
+		total.Fat += ing.Fat
+	}
+	rec.Total = roundNutrition(total)
+
+	portions := float64(rec.Portions)
+	if portions < 1 {
+		portions = 1
+	}
+	rec.PerPortion = roundNutrition(nutrition{total.Calories / portions, total.Protein / portions, total.Carbohydrate / portions, total.Fat / portions})
+}
+
+func roundNutrition(n nutrition) nutrition {
+	round := func(v float64) float64 { return math.Round(v*10) / 10 }
+	return nutrition{round(n.Calories), round(n.Protein), round(n.Carbohydrate), round(n.Fat)}
+}
+
+func insertOrUpdateRecipe(rec recipe, username string) error {
+	if rec.ID != 0 {
+		_, err := database.Exec("UPDATE recipe SET name = ?, yield_amount = ?, yield_unit = ?, portions = ? WHERE id = ? AND username = ?",
+			rec.Name, rec.YieldAmount, rec.YieldUnit, rec.Portions, rec.ID, username)
+		return err
+	}
+	_, err := database.Exec("INSERT INTO recipe (name, yield_amount, yield_unit, portions, username) VALUES (?, ?, ?, ?, ?)",
+		rec.Name, rec.YieldAmount, rec.YieldUnit, rec.Portions, username)
+	return err
+}
+
+func deleteRecipe(id int, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM recipe WHERE id = ? AND username = ?", id, username)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM recipe_ingredient WHERE recipe_id = ?", id); err != nil {
+		return err
+	}
+	// logged portions keep their calories, they just lose the link
+	if _, err = tx.Exec("UPDATE calorie_entry SET recipe_id = NULL WHERE recipe_id = ? AND username = ?", id, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertOrUpdateIngredient(id, recipeID, foodID int, quantity float64, username string) error {
+	var owned int
+	row := database.QueryRow(`
+		SELECT COUNT(*) FROM recipe r, food f
+		WHERE r.id = ? AND r.username = ? AND f.id = ? AND f.username = ?`, recipeID, username, foodID, username)
+	if err := row.Scan(&owned); err != nil {
+		return err
+	}
+	if owned == 0 {
+		return sql.ErrNoRows
+	}
+
+	if id != 0 {
+		_, err := database.Exec("UPDATE recipe_ingredient SET food_id = ?, quantity = ? WHERE id = ? AND recipe_id = ?", foodID, quantity, id, recipeID)
+		return err
+	}
+	_, err := database.Exec("INSERT INTO recipe_ingredient (recipe_id, food_id, quantity) VALUES (?, ?, ?)", recipeID, foodID, quantity)
+	return err
+}
+
+func deleteIngredient(id int, username string) error {
+	_, err := database.Exec("DELETE FROM recipe_ingredient WHERE id = ? AND recipe_id IN (SELECT id FROM recipe WHERE username = ?)", id, username)
+	return err
+}
+
+func addRecipeCalorieEntry(day time.Time, amount int, category string, recipeID int, username string) error {
+	date := day.Format(time.RFC3339)
+	_, err := database.Exec("INSERT INTO calorie_entry (date, amount, category, recipe_id, username) VALUES (?, ?, ?, ?, ?)", date, amount, category, recipeID, username)
+	if err != nil {
+		return err
+	}
+	return addCategory(database, category, username)
+}
+
+func foodsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		setFoodHandler(w, r)
+	} else if r.Method == "GET" {
+		getFoodsHandler(w, r)
+	} else {
+		notFound(w, r)
+	}
+}
+
+func setFoodHandler(w http.ResponseWriter, r *http.Request) {
+	f := food{Name: r.FormValue("name"), Unit: r.FormValue("unit")}
+	if f.Name == "" || f.Unit == "" {
+		badRequest(w, r, "a name and unit are required", validationError{Field: "name", Message: "a name is required"}, validationError{Field: "unit", Message: "a unit is required"})
+		return
+	}
+
+	var ok bool
+	if r.FormValue("id") != "" {
+		if f.ID, ok = formInt(r, "id"); !ok {
+			invalidField(w, r, "id", "id must be a whole number")
+			return
+		}
+	}
+	if f.PortionSize, ok = formFloat(r, "portion_size"); !ok || f.PortionSize <= 0 {
+		invalidField(w, r, "portion_size", "portion size must be a number greater than 0")
+		return
+	}
+	if f.Calories, ok = formFloat(r, "calories"); !ok || f.Calories < 0 {
+		invalidField(w, r, "calories", "calories must be a number of at least 0")
+		return
+	}
+
+	// macros are optional, as plenty of labels and home recipes don't have them
+	for key, target := range map[string]*float64{"protein": &f.Protein, "carbohydrate": &f.Carbohydrate, "fat": &f.Fat} {
+		if r.FormValue(key) == "" {
+			continue
+		}
+		if *target, ok = formFloat(r, key); !ok || *target < 0 {
+			invalidField(w, r, key, key+" must be a number of at least 0")
+			return
+		}
+	}
+
+	err := insertOrUpdateFood(f, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func getFoodsHandler(w http.ResponseWriter, r *http.Request) {
+	foods, err := getFoods(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(foods)
+	case mimeText:
+		for _, f := range foods {
+			fmt.Fprintf(w, "%d\t%s\t%g%s\t%g Cal\n", f.ID, f.Name, f.PortionSize, f.Unit, f.Calories)
+		}
+	}
+}
+
+func deleteFoodHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	err := deleteFood(id, currentUser(r))
+	if err == errFoodInUse {
+		writeError(w, r, http.StatusConflict, errorResponse{Code: codeConflict, Message: "food is used by a recipe"})
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func recipesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		setRecipeHandler(w, r)
+	} else if r.Method == "GET" {
+		getRecipesHandler(w, r)
+	} else {
+		notFound(w, r)
+	}
+}
+
+func setRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	rec := recipe{Name: r.FormValue("name"), YieldUnit: r.FormValue("yield_unit")}
+	if rec.Name == "" {
+		invalidField(w, r, "name", "a name is required")
+		return
+	}
+
+	var ok bool
+	if r.FormValue("id") != "" {
+		if rec.ID, ok = formInt(r, "id"); !ok {
+			invalidField(w, r, "id", "id must be a whole number")
+			return
+		}
+	}
+	if rec.Portions, ok = formInt(r, "portions"); !ok || rec.Portions < 1 {
+		invalidField(w, r, "portions", "portions must be a whole number of at least 1")
+		return
+	}
+	if r.FormValue("yield_amount") != "" {
+		if rec.YieldAmount, ok = formFloat(r, "yield_amount"); !ok || rec.YieldAmount < 0 {
+			invalidField(w, r, "yield_amount", "yield amount must be a number of at least 0")
+			return
+		}
+	}
+
+	err := insertOrUpdateRecipe(rec, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func getRecipesHandler(w http.ResponseWriter, r *http.Request) {
+	recipes, err := getRecipes(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(recipes)
+	case mimeText:
+		for _, rec := range recipes {
+			fmt.Fprintf(w, "%d\t%s\t%d portions\t%g Cal per portion\n", rec.ID, rec.Name, rec.Portions, rec.PerPortion.Calories)
+			for _, ing := range rec.Ingredients {
+				fmt.Fprintf(w, "\t%g%s %s\t%g Cal\n", ing.Quantity, ing.Unit, ing.Food, ing.Calories)
+			}
+		}
+	}
+}
+
+func deleteRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	err := deleteRecipe(id, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func ingredientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	var id int
+	var ok bool
+	if r.FormValue("id") != "" {
+		if id, ok = formInt(r, "id"); !ok {
+			invalidField(w, r, "id", "id must be a whole number")
+			return
+		}
+	}
+	recipeID, ok := formInt(r, "recipe_id")
+	if !ok {
+		invalidField(w, r, "recipe_id", "recipe id must be a whole number")
+		return
+	}
+	foodID, ok := formInt(r, "food_id")
+	if !ok {
+		invalidField(w, r, "food_id", "food id must be a whole number")
+		return
+	}
+	quantity, ok := formFloat(r, "quantity")
+	if !ok || quantity <= 0 {
+		invalidField(w, r, "quantity", "quantity must be a number greater than 0")
+		return
+	}
+
+	err := insertOrUpdateIngredient(id, recipeID, foodID, quantity, currentUser(r))
+	if err == sql.ErrNoRows {
+		badRequest(w, r, "no such recipe or food")
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func deleteIngredientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	err := deleteIngredient(id, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func logRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	recipeID, ok := formInt(r, "recipe_id")
+	if !ok {
+		invalidField(w, r, "recipe_id", "recipe id must be a whole number")
+		return
+	}
+
+	portions := 1.0
+	if r.FormValue("portions") != "" {
+		if portions, ok = formFloat(r, "portions"); !ok || portions <= 0 {
+			invalidField(w, r, "portions", "portions must be a number greater than 0")
+			return
+		}
+	}
+
+	currentUser := currentUser(r)
+	rec, err := getRecipe(recipeID, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if rec == nil {
+		invalidField(w, r, "recipe_id", "no such recipe")
+		return
+	}
+
+	// left uncategorised unless one is given, so that recipes don't each turn
+	// into a category of their own
+	category := r.FormValue("category")
+
+	amount := int(math.Round(rec.PerPortion.Calories * portions))
+	err = addRecipeCalorieEntry(time.Now(), amount, category, rec.ID, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Reports summarise recorded days a week or a month at a time, like the
+// monthly charts in the Hacker Diet. The estimated deficit is worked out from
+// how the trend moved over the period rather than from calories logged, so it
+// holds up even when logging is patchy.
+
+type periodReport struct {
+	Start           string
+	End             string
+	AverageWeight   float64
+	StartTrend      float64
+	EndTrend        float64
+	TrendChange     float64
+	AverageCalories int
+	DaysLogged      int
+	DaysUnderBudget int
+	DailyDeficit    int
+	Categories      map[string]int
+}
+
+func monthStart(day time.Time) time.Time {
+	y, m, _ := day.Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, day.Location())
+}
+
+func weekEnd(start time.Time) time.Time {
+	return start.AddDate(0, 0, 6)
+}
+
+func monthEnd(start time.Time) time.Time {
+	return start.AddDate(0, 1, -1)
+}
+
+// calcReports groups days into periods, given functions for where a day's
+// period starts and where a period ends. Calorie averages only count the
+// days that had something logged. Today isn't counted as under budget, as
+// there's still time left to go over.
+func calcReports(days []recordedDay, timeline goalTimeline, periodStart, periodEnd func(time.Time) time.Time, now time.Time) []periodReport {
+	today := now.Format("2006-01-02")
+	result := make([]periodReport, 0)
+	trend := calcWeightTrend(days)
+
+	var report *periodReport
+	var weightSum float64
+	var calorieDays, calorieSum int
+	var categorySums map[string]int
+	var firstDate, lastDate time.Time
+
+	finish := func() {
+		if report == nil {
+			return
+		}
+		report.AverageWeight = math.Round(weightSum/float64(report.DaysLogged)*100) / 100
+		report.TrendChange = math.Round((report.EndTrend-report.StartTrend)*100) / 100
+		if elapsed := lastDate.Sub(firstDate).Hours() / 24; elapsed >= 1 {
+			report.DailyDeficit = int(math.Round(-report.TrendChange * 7700 / elapsed))
+		}
+		if calorieDays > 0 {
+			report.AverageCalories = calorieSum / calorieDays
+			for category, sum := range categorySums {
+				report.Categories[category] = sum / calorieDays
+			}
+		}
+		result = append(result, *report)
+	}
+
+	for i, day := range days {
+		date, err := time.Parse(time.RFC3339, day.Date)
+		if err != nil {
+			continue
+		}
+
+		start := periodStart(date).Format("2006-01-02")
+		if report == nil || report.Start != start {
+			finish()
+			report = &periodReport{Start: start, End: periodEnd(periodStart(date)).Format("2006-01-02"), StartTrend: trend[i].Weighted, Categories: map[string]int{}}
+			weightSum, calorieDays, calorieSum, categorySums = 0, 0, 0, map[string]int{}
+			firstDate = date
+		}
+
+		report.DaysLogged++
+		report.EndTrend = trend[i].Weighted
+		weightSum += day.Weight
+		lastDate = date
+
+		if len(day.Entries) == 0 {
+			continue
+		}
+		total := 0
+		for _, entry := range day.Entries {
+			total += entry.Amount
+			categorySums[entry.Category] += entry.Amount
+		}
+		calorieDays++
+		calorieSum += total
+		if day.Date[:10] >= today {
+			continue
+		}
+		if dayMax := calcDayMax(timeline.on(date), day.Weight, date); dayMax != nil && total <= *dayMax {
+			report.DaysUnderBudget++
+		}
+	}
+	finish()
+
+	return result
+}
+
+func reportCategories(reports []periodReport) []string {
+	categorySet := map[string]bool{}
+	for _, report := range reports {
+		for category := range report.Categories {
+			categorySet[category] = true
+		}
+	}
+	result := make([]string, 0, len(categorySet))
+	for category := range categorySet {
+		result = append(result, category)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// writeReportsCSV gives each category its own column, so the file opens
+// cleanly in a spreadsheet.
+func writeReportsCSV(w http.ResponseWriter, reports []periodReport) {
+	categories := reportCategories(reports)
+
+	writer := csv.NewWriter(w)
+	header := []string{"start", "end", "average_weight", "start_trend", "end_trend", "trend_change", "average_calories", "days_logged", "days_under_budget", "daily_deficit"}
+	writer.Write(append(header, categories...))
+	for _, report := range reports {
+		row := []string{
+			report.Start,
+			report.End,
+			strconv.FormatFloat(report.AverageWeight, 'f', -1, 64),
+			strconv.FormatFloat(report.StartTrend, 'f', -1, 64),
+			strconv.FormatFloat(report.EndTrend, 'f', -1, 64),
+			strconv.FormatFloat(report.TrendChange, 'f', -1, 64),
+			strconv.Itoa(report.AverageCalories),
+			strconv.Itoa(report.DaysLogged),
+			strconv.Itoa(report.DaysUnderBudget),
+			strconv.Itoa(report.DailyDeficit),
+		}
+		for _, category := range categories {
+			row = append(row, strconv.Itoa(report.Categories[category]))
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+}
+
+func reportHandler(periodStart, periodEnd func(time.Time) time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			notFound(w, r)
+			return
+		}
+
+		currentUser := currentUser(r)
+		days, err := allDaysForUser(currentUser)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+
+		timeline, err := getGoalTimeline(currentUser)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+
+		result := calcReports(days, *timeline, periodStart, periodEnd, time.Now())
+
+		switch negotiateResponse(w, r, mimeText, mimeJSON, mimeCSV) {
+		case mimeJSON:
+			json.NewEncoder(w).Encode(result)
+		case mimeCSV:
+			writeReportsCSV(w, result)
+		case mimeText:
+			for _, report := range result {
+				fmt.Fprintf(w, "%s to %s\n", report.Start, report.End)
+				fmt.Fprintf(w, "weight %g, trend %g to %g (%+g)\n", report.AverageWeight, report.StartTrend, report.EndTrend, report.TrendChange)
+				fmt.Fprintf(w, "%d days logged, %d under budget, %d cal average, %d cal daily deficit\n", report.DaysLogged, report.DaysUnderBudget, report.AverageCalories, report.DailyDeficit)
+				for _, category := range reportCategories([]periodReport{report}) {
+					fmt.Fprintf(w, "%d\t%s\n", report.Categories[category], category)
+				}
+				fmt.Fprintln(w)
+			}
+		}
+	}
+}
@@ -2,21 +2,29 @@
 function getResponse(path, onResult) {
     var request = new XMLHttpRequest();
     request.open('GET', path, true);
-    request.setRequestHeader("Content-Type", "application/json");
+    request.setRequestHeader("Accept", "application/json");
     request.onload = function() {
+        if (this.status === 403 && JSON.parse(this.response).Code === "second_factor_required") {
+            location = "/login/totp";
+            return;
+        }
         var resp = this.response;
         onResult(JSON.parse(resp));
     };
     request.send();
 }
 
-function sendData(path, body, onSuccess) {
+function sendData(path, body, onSuccess, onError) {
     var request = new XMLHttpRequest();
     request.open("POST", path, true);
     request.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
     request.onreadystatechange = function() { // Call a function when the state changes.
-        if (this.readyState === XMLHttpRequest.DONE && this.status === 202) {
-            onSuccess();
+        if (this.readyState !== XMLHttpRequest.DONE)
+            return;
+        if (this.status === 202) {
+            onSuccess(this);
+        } else if (onError) {
+            onError(this);
         }
     }
     request.send(body);
@@ -36,6 +44,7 @@ document.querySelector("#show-set-weight").addEventListener("click", function()
 
 document.querySelector("#show-trends").addEventListener("click", function() {
     showTrendSection();
+    showBudgetHistory();
 });
 
 document.querySelector("#show-set-goals").addEventListener("click", function() {
@@ -46,6 +55,10 @@ document.querySelector("#show-add-calorie-entry").addEventListener("click", func
     showAddEntrySection();
 });
 
+document.querySelector("#show-profile").addEventListener("click", function() {
+    showProfileSection();
+});
+
 var cancelElems = document.querySelectorAll(".cancel-button");
 for (var i = 0; i < cancelElems.length; i++) {
     cancelElems[i].addEventListener("click", function() {
@@ -61,11 +74,16 @@ document.querySelector("#set-weight").addEventListener("click", function() {
 });
 
 var goalsElems = {
+    kind: document.querySelector("#goal-kind"),
+    band: document.querySelector("#goal-band"),
     currentWeight: document.querySelector("#current-weight"),
     targetWeight: document.querySelector("#target-weight"),
     targetDate: document.querySelector("#target-date"),
     dailyBurnRate: document.querySelector("#daily-burn-rate"),
+    includeExercise: document.querySelector("#include-exercise"),
 };
+goalsElems.kind.addEventListener("change", function() { calculateRates(); });
+goalsElems.band.addEventListener("change", function() { calculateRates(); });
 goalsElems.currentWeight.addEventListener("change", function() { calculateRates(); });
 goalsElems.targetWeight.addEventListener("change", function() { calculateRates(); });
 goalsElems.targetDate.addEventListener("change", function() { calculateRates(); });
@@ -90,6 +108,15 @@ document.querySelector(".download-data-text").addEventListener("click", function
 document.querySelector(".download-data-json").addEventListener("click", function() {
     window.location.href = "/history?asfile=json";
 });
+document.querySelector(".download-data-csv").addEventListener("click", function() {
+    window.location.href = "/history?asfile=csv";
+});
+document.querySelector(".download-chart-png").addEventListener("click", function() {
+    window.location.href = "/history/trend.png?calories=true";
+});
+document.querySelector(".download-report-pdf").addEventListener("click", function() {
+    window.location.href = "/reports/pdf";
+});
 
 function calculateRates() {
     document.querySelector("#goals-description").value = "";
@@ -98,6 +125,11 @@ function calculateRates() {
     if (!goalsElems.dailyBurnRate.value) {
         return;
     }
+    if (goalsElems.kind.value == "maintain") {
+        document.querySelector("#goals-description").innerText = goalsElems.dailyBurnRate.value+" calories per day to maintain";
+        document.querySelector("#set-goals").removeAttribute("disabled");
+        return;
+    }
     var days = (Date.parse(goalsElems.targetDate.value) - (new Date()).getTime()) / (1000 * 3600 * 24);
     if(isNaN(days))
         return;
@@ -106,7 +138,7 @@ function calculateRates() {
     var toLose = goalsElems.currentWeight.value - goalsElems.targetWeight.value;
     var deficitPerDay = (toLose * calsPerKG) / days;
     var target = goalsElems.dailyBurnRate.value - deficitPerDay;
-    if (isNaN(target) || target < 500)
+    if (isNaN(target))
         return;
 
     document.querySelector("#goals-description").innerText = Math.round(target)+" calories per day to meet goal";
@@ -114,12 +146,106 @@ function calculateRates() {
 }
 
 document.querySelector("#set-goals").addEventListener("click", function() {
-    var data = "target_weight=" + goalsElems.targetWeight.value;
+    var data = "kind=" + goalsElems.kind.value;
+    data += "&target_weight=" + goalsElems.targetWeight.value;
     data += "&target_date=" + goalsElems.targetDate.value;
+    if (goalsElems.kind.value == "maintain")
+        data += "&band=" + goalsElems.band.value;
     data += "&daily_burn_rate=" + goalsElems.dailyBurnRate.value;
+    data += "&include_exercise=" + goalsElems.includeExercise.checked;
     sendData("/goals", data, function() {
         showTodaySection();
+    }, function(request) {
+        var description = document.querySelector("#goals-description");
+        var error = JSON.parse(request.responseText);
+        if (!error.Fields) {
+            description.innerText = error.Message;
+            return;
+        }
+        description.innerText = error.Fields.map(function(e) { return e.Message; }).join("\n");
+        var suggestion = error.Fields.filter(function(e) { return e.Field === "target_date" && e.Suggestion; })[0];
+        if (suggestion) {
+            description.innerText += "\nTry a target date of " + suggestion.Suggestion + " or later.";
+            goalsElems.targetDate.value = suggestion.Suggestion;
+        }
+    });
+});
+
+document.querySelector("#set-profile").addEventListener("click", function() {
+    var data = "height=" + document.querySelector("#profile-height").value;
+    data += "&sex=" + document.querySelector("#profile-sex").value;
+    data += "&birth_date=" + document.querySelector("#profile-birth-date").value;
+    data += "&activity_level=" + document.querySelector("#profile-activity-level").value;
+    sendData("/profile", data, function() {
+        showProfileSection(true);
+        showGoalsSection(true);
+        showTodaySection();
+    });
+});
+
+document.querySelector("#change-password").addEventListener("click", function() {
+    var description = document.querySelector("#password-description");
+    var newPassword = document.querySelector("#new-password").value;
+    if (newPassword !== document.querySelector("#confirm-password").value) {
+        description.innerText = "The new passwords don't match.";
+        return;
+    }
+    var data = "current_password=" + encodeURIComponent(document.querySelector("#current-password").value);
+    data += "&new_password=" + encodeURIComponent(newPassword);
+    sendData("/profile/password", data, function() {
+        description.innerText = "Password changed, you'll be asked to log in again.";
+        setTimeout(function() { location.reload(); }, 2000);
+    }, function(request) {
+        description.innerText = JSON.parse(request.responseText).Message;
+    });
+});
+
+function showTOTPStatus() {
+    getResponse("/profile/totp", function(status) {
+        var text = "Off, only your password is needed to log in.";
+        if (status.Enabled)
+            text = "On, with " + status.RecoveryCodesLeft + " recovery codes left.";
+        document.querySelector("#totp-status").innerText = text;
+        document.querySelector("#enrol-totp").classList.toggle("hide", status.Enabled);
+        document.querySelector("#disable-totp").classList.toggle("hide", !status.Enabled);
     });
+}
+
+function showTOTPError(request) {
+    document.querySelector("#totp-description").innerText = JSON.parse(request.responseText).Message;
+}
+
+document.querySelector("#enrol-totp").addEventListener("click", function() {
+    var data = "current_password=" + encodeURIComponent(document.querySelector("#totp-password").value);
+    sendData("/profile/totp/enrol", data, function(request) {
+        var enrolment = JSON.parse(request.responseText);
+        document.querySelector("#totp-uri").href = enrolment.URI;
+        document.querySelector("#totp-secret").innerText = enrolment.Secret;
+        document.querySelector("#totp-setup").classList.remove("hide");
+        document.querySelector("#totp-description").innerText = "";
+    }, showTOTPError);
+});
+
+document.querySelector("#confirm-totp").addEventListener("click", function() {
+    var data = "code=" + encodeURIComponent(document.querySelector("#totp-code").value);
+    sendData("/profile/totp/confirm", data, function(request) {
+        var confirmation = JSON.parse(request.responseText);
+        var codes = document.querySelector("#recovery-codes");
+        codes.innerText = confirmation.RecoveryCodes.join("\n");
+        codes.classList.remove("hide");
+        document.querySelector("#totp-setup").classList.add("hide");
+        document.querySelector("#totp-description").innerText = "Keep these recovery codes somewhere safe, each can be used once instead of a code and they won't be shown again.";
+        showTOTPStatus();
+    }, showTOTPError);
+});
+
+document.querySelector("#disable-totp").addEventListener("click", function() {
+    var data = "current_password=" + encodeURIComponent(document.querySelector("#totp-password").value);
+    sendData("/profile/totp/disable", data, function() {
+        document.querySelector("#recovery-codes").classList.add("hide");
+        document.querySelector("#totp-description").innerText = "";
+        showTOTPStatus();
+    }, showTOTPError);
 });
 
 document.querySelector("#add-entry").addEventListener("click", function() {
@@ -188,6 +314,26 @@ function showTodaySection() {
             document.querySelector("#total-consumed").innerText += " / " + today.TodayMax + " Cal";
         }
 
+        if (today.ExerciseBurn > 0) {
+            document.querySelector("#total-consumed").innerText += " (" + today.ExerciseBurn + " Cal exercised)";
+        }
+
+        var maintenance = document.querySelector("#maintenance-status");
+        maintenance.innerText = "";
+        if (today.Maintenance && today.Maintenance.Correction != 0) {
+            maintenance.innerText = "Trend is "+Math.abs(today.Maintenance.Drift)+" KG "+(today.Maintenance.Drift > 0 ? "above" : "below")+" your band: ";
+            maintenance.innerText += (today.Maintenance.Correction > 0 ? "eat " : "cut ")+Math.abs(today.Maintenance.Correction)+" Cal per day to get back";
+        }
+
+        var budgets = document.querySelector("#today-budgets");
+        budgets.innerHTML = "";
+        for (var i = 0; i < today.Budgets.length; i++) {
+            var budget = today.Budgets[i];
+            var htmlToAdd = "<tr><td>"+budget.Category+"</td>"
+            htmlToAdd += "<td>"+budget.Remaining+" / "+budget.Budget+" Cal left</td></tr>"
+            budgets.innerHTML += htmlToAdd;
+        }
+
         changeSection("#today-section");
     });
 }
@@ -221,50 +367,84 @@ function showGoalsSection(dontSwitch) {
             document.querySelector("#daily-burn-rate").value = goals.BurnRate;
         }
 
+        if (goals.Kind) {
+            goalsElems.kind.value = goals.Kind;
+        }
+
+        if (goals.Band && goals.Band != 0) {
+            goalsElems.band.value = goals.Band;
+        }
+
+        goalsElems.includeExercise.checked = goals.IncludeExercise;
+
+        if (goals.HealthyWeightMin && goals.HealthyWeightMax) {
+            document.querySelector("#healthy-range").innerText = "Healthy weight for your height: "+goals.HealthyWeightMin+" - "+goals.HealthyWeightMax+" KG";
+        }
+
         if(!dontSwitch)
             changeSection("#set-goals-section");
     });
+    showGoalHistory();
+}
+
+function showGoalHistory() {
+    getResponse("/goals/history", function(phases) {
+        var table = document.querySelector("#goal-history");
+        table.innerHTML = "";
+        phases.forEach(function(phase) {
+            var row = document.createElement("tr");
+            [phase.Kind, phase.Status, phase.StartDate, phase.TargetWeight+" KG", phase.TargetDate, phase.EndDate].forEach(function(text) {
+                var cell = document.createElement("td");
+                cell.innerText = text;
+                row.appendChild(cell);
+            });
+            table.appendChild(row);
+        });
+    });
+}
+
+function showProfileSection(dontSwitch) {
+    getResponse("/profile", function(profile) {
+        if (profile.Height && profile.Height != 0) {
+            document.querySelector("#profile-height").value = profile.Height;
+        }
+        if (profile.Sex) {
+            document.querySelector("#profile-sex").value = profile.Sex;
+        }
+        if (profile.BirthDate) {
+            document.querySelector("#profile-birth-date").value = profile.BirthDate;
+        }
+        if (profile.ActivityLevel) {
+            document.querySelector("#profile-activity-level").value = profile.ActivityLevel;
+        }
+
+        var description = "";
+        if (profile.BMI) {
+            description = "BMI "+profile.BMI+" (trend "+profile.TrendBMI+")";
+        }
+        document.querySelector("#profile-description").innerText = description;
+
+        if (profile.SuggestedBurnRate) {
+            document.querySelector("#burn-rate-hint").innerText = "Based on your profile, around "+profile.SuggestedBurnRate+" calories.";
+        }
+
+        if(!dontSwitch)
+            changeSection("#profile-section");
+    });
+    showTOTPStatus();
 }
 
 function showTrendSection(dontSwitch) {
     getResponse('/history/trend', function(result) {
     
-        labels = [];
-        recorded = [];
         weighted = [];
         for (var i = 0; i < result.length; i++) {
-            labels.push(result[i].Date);
-            recorded.push(result[i].Recorded);
             weighted.push(result[i].Weighted);
         }
     
-        var chartContext = document.querySelector("#chart-canvas").getContext('2d');
-        Chart.defaults.global.defaultFontColor = '#fff';
-    
-        new Chart(chartContext, {
-            type: 'line',
-            data: {
-                labels: labels,
-                datasets: [{
-                    label: 'Recorded',
-                    data: recorded,
-                    borderColor: [
-                        '#fff'
-                    ],
-                    borderWidth: 1,
-                    fill: false
-                },
-                {
-                    label: 'Weighted 2 wk average',
-                    data: weighted,
-                    borderColor: [
-                        '#0f0'
-                    ],
-                    borderWidth: 1,
-                    fill: false
-                }]
-            }
-        });
+        var chart = document.querySelector("#trend-chart");
+        var width = Math.max(200, Math.min(800, chart.parentNode.clientWidth || window.innerWidth));
+        chart.src = "/history/trend.svg?calories=true&width=" + Math.round(width) + "&height=" + Math.round(width / 2) + "&t=" + Date.now();
 
         // calculate trend arrow
 
@@ -336,9 +516,23 @@ function showTrendSection(dontSwitch) {
     });
 }
 
+function showBudgetHistory() {
+    getResponse('/history/budgets', function(result) {
+        var history = document.querySelector("#budget-history");
+        history.innerHTML = "";
+        for (var i = 0; i < result.length; i++) {
+            var htmlToAdd = "<tr><td>"+result[i].Category+"</td>"
+            htmlToAdd += "<td>over on "+result[i].DaysOver+" of "+result[i].DaysCounted+" days</td></tr>"
+            history.innerHTML += htmlToAdd;
+        }
+    });
+}
+
 showAddEntrySection(true);
 showGoalsSection(true);
+showProfileSection(true);
 showTrendSection(true);
+showBudgetHistory();
 window.addEventListener("resize", function() {
     showTrendSection(true);
 });
@@ -0,0 +1,22 @@
+function submitCode() {
+    var request = new XMLHttpRequest();
+    request.open("POST", "/login/totp", true);
+    request.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+    request.onreadystatechange = function() {
+        if (this.readyState !== XMLHttpRequest.DONE)
+            return;
+        if (this.status === 202) {
+            location = "/";
+        } else {
+            document.querySelector("#totp-login-description").innerText = JSON.parse(this.responseText).Message;
+        }
+    }
+    request.send("code=" + encodeURIComponent(document.querySelector("#totp-login-code").value));
+}
+
+document.querySelector("#totp-login").addEventListener("click", submitCode);
+
+document.querySelector("#totp-login-code").addEventListener("keyup", function(e) {
+    if (e.key === "Enter")
+        submitCode();
+});
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+func renderTrendSVG(data chartData, options chartOptions) []byte {
+	l := newChartLayout(data, options)
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n",
+		options.Width, options.Height, options.Width, options.Height)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", chartTheme.Background)
+
+	if len(data.Points) == 0 {
+		fmt.Fprintf(&b, `<text x="%g" y="%g" fill="%s" text-anchor="middle">No weights recorded</text>`+"\n", l.width/2, l.height/2, chartTheme.Text)
+		b.WriteString("</svg>\n")
+		return b.Bytes()
+	}
+
+	if options.Calories {
+		barWidth := l.barWidth()
+		for _, p := range data.Points {
+			height := l.barHeight(p.Calories)
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n", l.x(p.Date)-barWidth/2, l.bottom-height, barWidth, height, chartTheme.Calories)
+		}
+	}
+
+	for _, tick := range l.weightTicks() {
+		y := l.y(tick)
+		fmt.Fprintf(&b, `<line x1="%g" y1="%.1f" x2="%g" y2="%.1f" stroke="%s" stroke-width="0.5"/>`+"\n", l.left, y, l.right, y, chartTheme.Axis)
+		fmt.Fprintf(&b, `<text x="%g" y="%.1f" fill="%s" text-anchor="end" dominant-baseline="middle">%s</text>`+"\n", l.left-5, y, chartTheme.Text, formatTick(tick))
+	}
+	for _, tick := range l.dateTicks() {
+		fmt.Fprintf(&b, `<text x="%.1f" y="%g" fill="%s" text-anchor="middle">%s</text>`+"\n", l.dateLabelX(tick), l.bottom+18, chartTheme.Text, tick.Format("2006-01-02"))
+	}
+	fmt.Fprintf(&b, `<line x1="%g" y1="%g" x2="%g" y2="%g" stroke="%s"/>`+"\n", l.left, l.bottom, l.right, l.bottom, chartTheme.Axis)
+
+	if data.Goal != 0 {
+		y := l.y(data.Goal)
+		fmt.Fprintf(&b, `<line x1="%g" y1="%.1f" x2="%g" y2="%.1f" stroke="%s" stroke-dasharray="6 4"/>`+"\n", l.left, y, l.right, y, chartTheme.Goal)
+	}
+
+	for _, p := range data.Points {
+		x := l.x(p.Date)
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"/>`+"\n", x, l.y(p.Recorded), x, l.y(p.Trend), p.sinkerColour(chartTheme))
+		fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2.5" fill="%s"/>`+"\n", x, l.y(p.Recorded), chartTheme.Recorded)
+	}
+
+	b.WriteString(`<polyline fill="none" stroke-width="2" stroke="` + chartTheme.Trend + `" points="`)
+	for _, p := range data.Points {
+		fmt.Fprintf(&b, "%.1f,%.1f ", l.x(p.Date), l.y(p.Trend))
+	}
+	b.WriteString("\"/>\n</svg>\n")
+
+	return b.Bytes()
+}
+
+// loadChartData gathers everything a chart needs for the current user.
+func loadChartData(r *http.Request, options chartOptions) (chartData, error) {
+	currentUser := currentUser(r)
+	days, err := allDaysForUser(currentUser)
+	if err != nil {
+		return chartData{}, err
+	}
+
+	timeline, err := getGoalTimeline(currentUser)
+	if err != nil {
+		return chartData{}, err
+	}
+
+	return buildChartData(days, *timeline, options), nil
+}
+
+// loadCalorieChartData is loadChartData for charts of what was eaten, which
+// include days without a weigh-in.
+func loadCalorieChartData(r *http.Request, options chartOptions) (chartData, error) {
+	currentUser := currentUser(r)
+	days, err := calorieDaysForUser(currentUser)
+	if err != nil {
+		return chartData{}, err
+	}
+
+	timeline, err := getGoalTimeline(currentUser)
+	if err != nil {
+		return chartData{}, err
+	}
+
+	return buildChartData(days, *timeline, options), nil
+}
+
+func trendSVGHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	options, ok := parseChartOptions(r)
+	if !ok {
+		badRequest(w, r, "invalid chart options, width and height must be within range and dates in the form yyyy-mm-dd")
+		return
+	}
+
+	data, err := loadChartData(r, options)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write(renderTrendSVG(data, options))
+}
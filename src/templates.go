@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// meal templates are named bundles of calorie entries, e.g. the usual
+// breakfast, that can be logged in one go.
+type mealTemplate struct {
+	ID      int
+	Name    string
+	Entries []calorieEntry
+	Total   int
+}
+
+func getMealTemplates(username string) ([]mealTemplate, error) {
+	rows, err := database.Query(`
+		SELECT t.id, t.name, e.id, e.amount, e.category, COALESCE(e.recipe_id, 0)
+		FROM meal_template t LEFT JOIN meal_template_entry e ON e.template_id = t.id
+		WHERE t.username = ? ORDER BY t.name, t.id, e.id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]mealTemplate, 0)
+	for rows.Next() {
+		var id int
+		var name string
+		var entryID, amount, recipeID sql.NullInt64
+		var category sql.NullString
+		err = rows.Scan(&id, &name, &entryID, &amount, &category, &recipeID)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(result) == 0 || result[len(result)-1].ID != id {
+			result = append(result, mealTemplate{id, name, []calorieEntry{}, 0})
+		}
+		if !entryID.Valid {
+			continue // template with no entries
+		}
+		template := &result[len(result)-1]
+		template.Entries = append(template.Entries, calorieEntry{int(entryID.Int64), int(amount.Int64), category.String, int(recipeID.Int64)})
+		template.Total += int(amount.Int64)
+	}
+
+	return result, nil
+}
+
+func insertOrUpdateMealTemplate(id int, name string, entries []calorieEntry, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if id != 0 {
+		res, err := tx.Exec("UPDATE meal_template SET name = ? WHERE id = ? AND username = ?", name, id, username)
+		if err != nil {
+			return err
+		}
+		if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM meal_template_entry WHERE template_id = ?", id); err != nil {
+			return err
+		}
+	} else {
+		res, err := tx.Exec("INSERT INTO meal_template (name, username) VALUES (?, ?)", name, username)
+		if err != nil {
+			return err
+		}
+		newID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = int(newID)
+	}
+
+	for _, entry := range entries {
+		_, err = tx.Exec("INSERT INTO meal_template_entry (template_id, amount, category, recipe_id) VALUES (?, ?, ?, ?)",
+			id, entry.Amount, entry.Category, nullableID(entry.RecipeID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func deleteMealTemplate(id int, username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM meal_template WHERE id = ? AND username = ?", id, username)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM meal_template_entry WHERE template_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// logCalorieEntries inserts all the given entries against day in a single
+// transaction, returning the ids of the new rows in the same order.
+func logCalorieEntries(day time.Time, entries []calorieEntry, username string) ([]int, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	date := day.Format(time.RFC3339)
+	ids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		res, err := tx.Exec("INSERT INTO calorie_entry (date, amount, category, recipe_id, username) VALUES (?, ?, ?, ?, ?)",
+			date, entry.Amount, entry.Category, nullableID(entry.RecipeID), username)
+		if err != nil {
+			return nil, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, int(id))
+
+		if err = addCategory(tx, entry.Category, username); err != nil {
+			return nil, err
+		}
+	}
+
+	return ids, tx.Commit()
+}
+
+func nullableID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		setTemplateHandler(w, r)
+	} else if r.Method == "GET" {
+		getTemplatesHandler(w, r)
+	} else {
+		notFound(w, r)
+	}
+}
+
+// setTemplateHandler expects a name and matching lists of amount and
+// category values, e.g. name=Breakfast&amount=200&category=Toast&amount=50&category=Coffee
+func setTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		badRequest(w, r, "invalid form")
+		return
+	}
+
+	name := r.FormValue("name")
+	amounts, categories := r.Form["amount"], r.Form["category"]
+	if name == "" || len(amounts) == 0 || len(amounts) != len(categories) {
+		badRequest(w, r, "a name and matching amounts and categories are required")
+		return
+	}
+
+	var id int
+	var ok bool
+	if r.FormValue("id") != "" {
+		if id, ok = formInt(r, "id"); !ok {
+			invalidField(w, r, "id", "id must be a whole number")
+			return
+		}
+	}
+
+	entries := make([]calorieEntry, len(amounts))
+	for i := range amounts {
+		entries[i].Amount, err = strconv.Atoi(amounts[i])
+		if err != nil || entries[i].Amount <= 0 {
+			invalidField(w, r, "amount", "amounts must be whole numbers greater than 0")
+			return
+		}
+		entries[i].Category = categories[i]
+	}
+
+	err = insertOrUpdateMealTemplate(id, name, entries, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func getTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := getMealTemplates(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(templates)
+	case mimeText:
+		for _, template := range templates {
+			fmt.Fprintf(w, "%d\t%s\t%d Cal\n", template.ID, template.Name, template.Total)
+			for _, entry := range template.Entries {
+				fmt.Fprintf(w, "\t%d\t%s\n", entry.Amount, entry.Category)
+			}
+		}
+	}
+}
+
+func deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	err := deleteMealTemplate(id, currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func logTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	id, ok := formInt(r, "id")
+	if !ok {
+		invalidField(w, r, "id", "id must be a whole number")
+		return
+	}
+
+	currentUser := currentUser(r)
+	templates, err := getMealTemplates(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	var entries []calorieEntry
+	for _, template := range templates {
+		if template.ID == id {
+			entries = template.Entries
+		}
+	}
+	if len(entries) == 0 {
+		invalidField(w, r, "id", "no such template")
+		return
+	}
+
+	ids, err := logCalorieEntries(time.Now(), entries, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeCreatedIDs(w, ids)
+}
+
+// copyCaloriesHandler copies all the entries from a previous day into today,
+// optionally limited to a single category (e.g. yesterday's breakfast).
+func copyCaloriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	date := r.FormValue("date")
+	if date == "" {
+		invalidField(w, r, "date", "a date is required")
+		return
+	}
+
+	day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		invalidField(w, r, "date", "date must be in the form yyyy-mm-dd")
+		return
+	}
+
+	currentUser := currentUser(r)
+	calories, err := getDayCalories(day, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	category := r.FormValue("category")
+	entries := make([]calorieEntry, 0)
+	for _, entry := range calories {
+		if category == "" || entry.Category == category {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		badRequest(w, r, "nothing to copy")
+		return
+	}
+
+	ids, err := logCalorieEntries(time.Now(), entries, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeCreatedIDs(w, ids)
+}
+
+// writeCreatedIDs lets the client undo individual entries of a bulk insert
+// via /calories/delete.
+func writeCreatedIDs(w http.ResponseWriter, ids []int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ids)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Two-factor authentication is optional, per user. Once it's turned on the
+// password, which is still checked on every request, isn't enough by itself:
+// each browser also needs a session, made by entering a code from the user's
+// authenticator app or one of their recovery codes. Codes follow RFC 6238
+// with the defaults that every authenticator app supports, SHA-1, 6 digits
+// and a 30 second step, and each can only be used once.
+
+const totpIssuer = "Hack Weight"
+const totpDigits = 6
+const totpStep = 30
+const totpSkew = 1 // steps either side of now that are accepted, for clock drift
+const recoveryCodeCount = 10
+const sessionCookie = "session"
+const sessionDuration = 30 * 24 * time.Hour
+const totpLoginPath = "/login/totp"
+
+type totpRecord struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+type totpStatus struct {
+	Enabled           bool
+	RecoveryCodesLeft int
+}
+
+type totpEnrolment struct {
+	Secret string
+	URI    string
+}
+
+type totpConfirmation struct {
+	RecoveryCodes []string
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// hashToken is for recovery codes and session tokens, which unlike passwords
+// are long and random enough that a fast hash is no help to anyone guessing.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// totpCode is the HOTP value (RFC 4226) for a step.
+func totpCode(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// matchTOTP returns the step a code is for, if it's right for a step around
+// now and after the last one used.
+func matchTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpStep
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(username, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(totpStep))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + values.Encode()
+}
+
+// normaliseCode takes out the spaces and dashes people type or copy along
+// with codes, and recovery codes are matched regardless of case.
+func normaliseCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	result := make([]string, recoveryCodeCount)
+	for i := range result {
+		b, err := randomBytes(7)
+		if err != nil {
+			return nil, err
+		}
+		code := totpEncoding.EncodeToString(b)[:10]
+		result[i] = code[:5] + "-" + code[5:]
+	}
+	return result, nil
+}
+
+func getTOTP(username string) (*totpRecord, error) {
+	var t totpRecord
+	row := database.QueryRow("SELECT secret, enabled, last_step FROM totp WHERE username = ?", username)
+	err := row.Scan(&t.Secret, &t.Enabled, &t.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// setPendingTOTP stores a new secret that isn't used for logging in until
+// enableTOTP, once the user has shown their app has it.
+func setPendingTOTP(username, secret string) error {
+	_, err := database.Exec("INSERT OR REPLACE INTO totp (username, secret, enabled, last_step) VALUES (?, ?, 0, 0)", username, secret)
+	return err
+}
+
+func enableTOTP(username string, step int64, recoveryCodes []string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE totp SET enabled = 1, last_step = ? WHERE username = ?", step, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_code WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	for _, code := range recoveryCodes {
+		_, err = tx.Exec("INSERT INTO recovery_code (username, code_hash) VALUES (?, ?)", username, hashToken(normaliseCode(code)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// useTOTPStep records a step as used, returning false if it, or a later one,
+// already was, so that a code can't be replayed.
+func useTOTPStep(username string, step int64) (bool, error) {
+	res, err := database.Exec("UPDATE totp SET last_step = ? WHERE username = ? AND last_step < ?", step, username, step)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+func useRecoveryCode(username, code string) (bool, error) {
+	res, err := database.Exec("DELETE FROM recovery_code WHERE username = ? AND code_hash = ?", username, hashToken(normaliseCode(code)))
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+func countRecoveryCodes(username string) (int, error) {
+	var result int
+	err := database.QueryRow("SELECT COUNT(*) FROM recovery_code WHERE username = ?", username).Scan(&result)
+	return result, err
+}
+
+// resetTOTP turns off two-factor authentication for a user, ending all of
+// their sessions.
+func resetTOTP(username string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"totp", "recovery_code", "session"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// resetUserTOTP is resetTOTP for the --reset-totp command.
+func resetUserTOTP(username string) error {
+	var exists bool
+	err := database.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("user %s not found", username)
+	}
+	return resetTOTP(username)
+}
+
+func createSession(username string, now time.Time) (string, time.Time, error) {
+	b, err := randomBytes(32)
+	if err != nil {
+		return "", now, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expires := now.Add(sessionDuration)
+
+	_, err = database.Exec("DELETE FROM session WHERE expires < ?", now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return "", now, err
+	}
+	_, err = database.Exec("INSERT INTO session (token_hash, username, expires) VALUES (?, ?, ?)", hashToken(token), username, expires.UTC().Format(time.RFC3339))
+	return token, expires, err
+}
+
+func validSession(username, token string, now time.Time) (bool, error) {
+	var exists bool
+	row := database.QueryRow("SELECT EXISTS (SELECT 1 FROM session WHERE token_hash = ? AND username = ? AND expires > ?)",
+		hashToken(token), username, now.UTC().Format(time.RFC3339))
+	err := row.Scan(&exists)
+	return exists, err
+}
+
+// needsSecondFactor reports whether a user with a valid password still has to
+// enter a code. The code entry page, and what it needs, are let through.
+func needsSecondFactor(r *http.Request, username string) (bool, error) {
+	if r.URL.Path == totpLoginPath || strings.HasPrefix(r.URL.Path, "/static/") {
+		return false, nil
+	}
+
+	t, err := getTOTP(username)
+	if err != nil || t == nil || !t.Enabled {
+		return false, err
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return true, nil
+	}
+	valid, err := validSession(username, cookie.Value, time.Now())
+	return !valid, err
+}
+
+// writeSecondFactorRequired sends people opening the app to the code entry
+// page, and tells anything else why it's been refused.
+func writeSecondFactorRequired(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && r.URL.Path == "/" {
+		http.Redirect(w, r, totpLoginPath, http.StatusSeeOther)
+		return
+	}
+	writeError(w, r, http.StatusForbidden, errorResponse{Code: codeSecondFactorRequired, Message: "a code from your authenticator app is required"})
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, username string) error {
+	token, expires, err := createSession(username, time.Now())
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// checkSecondFactor tests a code from an authenticator app, or failing that a
+// recovery code, using it up if it's right.
+func checkSecondFactor(username string, t *totpRecord, code string) (bool, error) {
+	if step, ok := matchTOTP(t.Secret, normaliseCode(code), time.Now(), t.LastStep); ok {
+		return useTOTPStep(username, step)
+	}
+	return useRecoveryCode(username, code)
+}
+
+func totpLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		html, err := ioutil.ReadFile("./totp.html")
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(html)
+		return
+	} else if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	currentUser := currentUser(r)
+	t, err := getTOTP(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if t == nil || !t.Enabled {
+		badRequest(w, r, "two-factor authentication isn't turned on")
+		return
+	}
+
+	// codes are short, so guesses count towards the same limits as passwords
+	attempt, wait, err := reserveLoginAttempt(r, currentUser, attemptConfirm, time.Now())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, r, wait)
+		return
+	}
+
+	valid, err := checkSecondFactor(currentUser, t, r.FormValue("code"))
+	if err != nil {
+		if refundErr := refundLoginAttempt(attempt); refundErr != nil {
+			logError(r, refundErr)
+		}
+		serverError(w, r, err)
+		return
+	}
+	if !valid {
+		logLoginFailure(r, attempt)
+		if attempt.addressWait > 0 {
+			writeTooManyAttempts(w, r, attempt.addressWait)
+			return
+		}
+		invalidField(w, r, "code", "incorrect code")
+		return
+	}
+
+	err = loginSucceeded(attempt)
+	if err == nil {
+		err = startSession(w, r, currentUser)
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func totpStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notFound(w, r)
+		return
+	}
+
+	currentUser := currentUser(r)
+	t, err := getTOTP(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	var status totpStatus
+	if t != nil && t.Enabled {
+		status.Enabled = true
+		status.RecoveryCodesLeft, err = countRecoveryCodes(currentUser)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+
+	switch negotiateResponse(w, r, mimeText, mimeJSON) {
+	case mimeJSON:
+		json.NewEncoder(w).Encode(status)
+	case mimeText:
+		fmt.Fprintln(w, status.Enabled)
+		fmt.Fprintln(w, status.RecoveryCodesLeft)
+	}
+}
+
+// checkPasswordField is for changes to how someone logs in, which need their
+// password even though the browser already has it.
+func checkPasswordField(w http.ResponseWriter, r *http.Request) bool {
+	valid, err := testAuthAgainstDB(currentUser(r), r.FormValue("current_password"))
+	if err != nil {
+		serverError(w, r, err)
+		return false
+	}
+	if !valid {
+		invalidField(w, r, "current_password", "current password is incorrect")
+		return false
+	}
+	return true
+}
+
+// enrolTOTPHandler starts setting up two-factor authentication, returning the
+// secret to add to an authenticator app, both as is and as the otpauth URI
+// that apps take from a link or QR code.
+func enrolTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+	if !checkPasswordField(w, r) {
+		return
+	}
+
+	currentUser := currentUser(r)
+	t, err := getTOTP(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if t != nil && t.Enabled {
+		writeError(w, r, http.StatusConflict, errorResponse{Code: codeConflict, Message: "two-factor authentication is already turned on"})
+		return
+	}
+
+	key, err := randomBytes(20)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	secret := totpEncoding.EncodeToString(key)
+
+	err = setPendingTOTP(currentUser, secret)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeJSON)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(totpEnrolment{secret, totpURI(currentUser, secret)})
+}
+
+// confirmTOTPHandler turns on two-factor authentication once a code shows the
+// app has the secret, returning recovery codes that are never shown again.
+// The browser used is given a session, so it isn't asked for a code straight
+// away.
+func confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+
+	currentUser := currentUser(r)
+	t, err := getTOTP(currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if t == nil || t.Enabled {
+		badRequest(w, r, "two-factor authentication isn't being set up")
+		return
+	}
+
+	step, ok := matchTOTP(t.Secret, normaliseCode(r.FormValue("code")), time.Now(), 0)
+	if !ok {
+		invalidField(w, r, "code", "incorrect code, check the time on your device")
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err == nil {
+		err = enableTOTP(currentUser, step, codes)
+	}
+	if err == nil {
+		err = startSession(w, r, currentUser)
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeJSON)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(totpConfirmation{codes})
+}
+
+func disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notFound(w, r)
+		return
+	}
+	if !checkPasswordField(w, r) {
+		return
+	}
+
+	err := resetTOTP(currentUser(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The test vectors from RFC 6238 for SHA-1, cut down to six digits.
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		if code := totpCode(key, test.time/totpStep); code != test.code {
+			t.Errorf("at %d: got %s, want %s", test.time, code, test.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpStep
+
+	if matched, ok := matchTOTP(secret, "050471", now, 0); !ok || matched != step {
+		t.Errorf("current code: got %d, %t, want %d, true", matched, ok, step)
+	}
+	if _, ok := matchTOTP(secret, "050471", now, step); ok {
+		t.Error("replayed code was accepted")
+	}
+	if _, ok := matchTOTP(secret, "050471", now.Add(time.Duration(totpSkew+1)*totpStep*time.Second), 0); ok {
+		t.Error("expired code was accepted")
+	}
+	if _, ok := matchTOTP(secret, "50471", now, 0); ok {
+		t.Error("short code was accepted")
+	}
+}
+
+// The password is sent with every request, so getting it right mustn't wipe
+// out the failed codes that come between. Once the wait is over, the right
+// code gets in and forgets them.
+func TestWrongCodesLockAccount(t *testing.T) {
+	db := openTestDatabase(t)
+	hash, err := generateArgonHash(passwordConfig, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestUser(t, db, "someone", hash)
+
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	if err = setPendingTOTP("someone", secret); err != nil {
+		t.Fatal(err)
+	}
+	if err = enableTOTP("someone", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(totpLoginPath, totpLoginHandler)
+	mux.HandleFunc("/", okHandler)
+	server := newTestServer(mux)
+	defer server.Close()
+
+	if status, code := get(t, server, "/today", "someone", "password"); status != http.StatusForbidden || code != codeSecondFactorRequired {
+		t.Fatalf("before code: got %d %s, want %d %s", status, code, http.StatusForbidden, codeSecondFactorRequired)
+	}
+
+	wrong := url.Values{"code": {"000000"}}
+	for i := 1; i <= loginFreeAttempts; i++ {
+		if status, code := post(t, server, totpLoginPath, "someone", "password", wrong); status != http.StatusBadRequest || code != codeInvalidRequest {
+			t.Fatalf("wrong code %d: got %d %s, want %d %s", i, status, code, http.StatusBadRequest, codeInvalidRequest)
+		}
+	}
+
+	right := url.Values{"code": {totpCode([]byte("12345678901234567890"), time.Now().Unix()/totpStep)}}
+	if status, code := post(t, server, totpLoginPath, "someone", "password", right); status != http.StatusTooManyRequests || code != codeTooManyRequests {
+		t.Errorf("right code once locked: got %d %s, want %d %s", status, code, http.StatusTooManyRequests, codeTooManyRequests)
+	}
+	if status, code := get(t, server, "/today", "someone", "password"); status != http.StatusForbidden || code != codeSecondFactorRequired {
+		t.Errorf("right password once locked: got %d %s, want %d %s", status, code, http.StatusForbidden, codeSecondFactorRequired)
+	}
+
+	failures, err := getLoginFailures("someone", attemptConfirm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures.Count != loginFreeAttempts {
+		t.Errorf("got %d failures recorded, want %d", failures.Count, loginFreeAttempts)
+	}
+
+	// move the failures back past the wait, as if it had passed
+	last := time.Now().Add(-loginMaxBackoff).Format(time.RFC3339)
+	if _, err = db.Exec("UPDATE login_attempt SET last_failure = ? WHERE username = ?", last, "someone"); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, code := post(t, server, totpLoginPath, "someone", "password", right); status != http.StatusAccepted {
+		t.Errorf("right code after waiting: got %d %s, want %d", status, code, http.StatusAccepted)
+	}
+
+	failures, err = getLoginFailures("someone", attemptConfirm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures.Count != 0 {
+		t.Errorf("got %d failures after logging in, want 0", failures.Count)
+	}
+}